@@ -0,0 +1,10 @@
+resource "fly_machine_exec" "warmCache" {
+  app        = "hellofromterraform"
+  machine_id = fly_machine.exampleMachine.id
+  command    = ["/app/bin/warm-cache", "--all"]
+
+  # warm the cache again whenever the machine runs a new image
+  triggers = {
+    image = fly_machine.exampleMachine.image
+  }
+}
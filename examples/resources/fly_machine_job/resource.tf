@@ -0,0 +1,14 @@
+resource "fly_machine_job" "migrate" {
+  app    = "hellofromterraform"
+  region = "iad"
+  image  = "registry.fly.io/hellofromterraform:deployment-01H6Z"
+  cmd    = ["bin/rails", "db:migrate"]
+  env = {
+    RAILS_ENV = "production"
+  }
+
+  # run the migrations again whenever a new image is deployed
+  triggers = {
+    image = "registry.fly.io/hellofromterraform:deployment-01H6Z"
+  }
+}
@@ -5,12 +5,14 @@ go 1.19
 require (
 	github.com/Khan/genqlient v0.6.0
 	github.com/hashicorp/terraform-plugin-framework v1.3.1
+	github.com/hashicorp/terraform-plugin-framework-timeouts v0.3.1
 	github.com/hashicorp/terraform-plugin-framework-validators v0.10.0
 	github.com/hashicorp/terraform-plugin-go v0.15.0
 	github.com/hashicorp/terraform-plugin-log v0.9.0
 	github.com/hashicorp/terraform-plugin-testing v1.3.0
 	github.com/imroc/req/v3 v3.37.1
 	github.com/vektah/gqlparser/v2 v2.5.3
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
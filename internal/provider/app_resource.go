@@ -7,9 +7,12 @@ import (
 	basegql "github.com/Khan/genqlient/graphql"
 	"github.com/fly-apps/terraform-provider-fly/graphql"
 	"github.com/fly-apps/terraform-provider-fly/internal/utils"
+	"github.com/hashicorp/terraform-plugin-framework-timeouts/resource/timeouts"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"github.com/vektah/gqlparser/v2/gqlerror"
@@ -18,9 +21,12 @@ import (
 var _ resource.Resource = &flyAppResource{}
 var _ resource.ResourceWithConfigure = &flyAppResource{}
 var _ resource.ResourceWithImportState = &flyAppResource{}
+var _ resource.ResourceWithModifyPlan = &flyAppResource{}
 
 type flyAppResource struct {
-	client *basegql.Client
+	client     *basegql.Client
+	timeouts   resourceTimeouts
+	defaultOrg string
 }
 
 func NewAppResource() resource.Resource {
@@ -38,17 +44,20 @@ func (r *flyAppResource) Configure(_ context.Context, req resource.ConfigureRequ
 
 	config := req.ProviderData.(ProviderConfig)
 	r.client = config.gqclient
+	r.timeouts = config.timeouts
+	r.defaultOrg = config.defaultOrg
 }
 
 type flyAppResourceData struct {
-	Name   types.String `tfsdk:"name"`
-	Org    types.String `tfsdk:"org"`
-	OrgId  types.String `tfsdk:"orgid"`
-	AppUrl types.String `tfsdk:"appurl"`
-	Id     types.String `tfsdk:"id"`
+	Name     types.String   `tfsdk:"name"`
+	Org      types.String   `tfsdk:"org"`
+	OrgId    types.String   `tfsdk:"orgid"`
+	AppUrl   types.String   `tfsdk:"appurl"`
+	Id       types.String   `tfsdk:"id"`
+	Timeouts timeouts.Value `tfsdk:"timeouts"`
 }
 
-func (r *flyAppResource) Schema(_ context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
+func (r *flyAppResource) Schema(ctx context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
 	resp.Schema = schema.Schema{
 		MarkdownDescription: "Fly app resource",
 
@@ -60,7 +69,10 @@ func (r *flyAppResource) Schema(_ context.Context, _ resource.SchemaRequest, res
 			"org": schema.StringAttribute{
 				Computed:            true,
 				Optional:            true,
-				MarkdownDescription: "Optional org slug to operate upon",
+				MarkdownDescription: "Optional org slug to operate upon. Defaults to the provider's `default_org`, then to the account's only org",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
 			},
 			"orgid": schema.StringAttribute{
 				Computed:            true,
@@ -75,9 +87,22 @@ func (r *flyAppResource) Schema(_ context.Context, _ resource.SchemaRequest, res
 				MarkdownDescription: "readonly appUrl",
 			},
 		},
+		Blocks: map[string]schema.Block{
+			"timeouts": timeouts.Block(ctx, timeouts.Opts{
+				Create: true,
+				Read:   true,
+				Update: true,
+				Delete: true,
+			}),
+		},
 	}
 }
 
+// ModifyPlan shows the provider's default_org as org of new apps that don't set one
+func (r *flyAppResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	planProviderDefault(ctx, req, resp, "org", "default_org", r.defaultOrg)
+}
+
 func (r *flyAppResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
 	var data flyAppResourceData
 
@@ -88,6 +113,14 @@ func (r *flyAppResource) Create(ctx context.Context, req resource.CreateRequest,
 		return
 	}
 
+	createTimeout, diags := data.Timeouts.Create(ctx, r.timeouts.Create)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, createTimeout)
+	defer cancel()
+
 	if data.Org.IsUnknown() {
 		defaultOrg, err := utils.GetDefaultOrg(ctx, *r.client)
 		if err != nil {
@@ -111,11 +144,12 @@ func (r *flyAppResource) Create(ctx context.Context, req resource.CreateRequest,
 	}
 
 	data = flyAppResourceData{
-		Org:    types.StringValue(mresp.CreateApp.App.Organization.Slug),
-		OrgId:  types.StringValue(mresp.CreateApp.App.Organization.Id),
-		Name:   types.StringValue(mresp.CreateApp.App.Name),
-		AppUrl: types.StringValue(mresp.CreateApp.App.AppUrl),
-		Id:     types.StringValue(mresp.CreateApp.App.Id),
+		Org:      types.StringValue(mresp.CreateApp.App.Organization.Slug),
+		OrgId:    types.StringValue(mresp.CreateApp.App.Organization.Id),
+		Name:     types.StringValue(mresp.CreateApp.App.Name),
+		AppUrl:   types.StringValue(mresp.CreateApp.App.AppUrl),
+		Id:       types.StringValue(mresp.CreateApp.App.Id),
+		Timeouts: data.Timeouts,
 	}
 
 	diags = resp.State.Set(ctx, &data)
@@ -135,6 +169,14 @@ func (r *flyAppResource) Read(ctx context.Context, req resource.ReadRequest, res
 		return
 	}
 
+	readTimeout, diags := state.Timeouts.Read(ctx, r.timeouts.Read)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
+
 	query, err := graphql.GetFullApp(ctx, *r.client, state.Name.ValueString())
 	var errList gqlerror.List
 	if errors.As(err, &errList) {
@@ -150,11 +192,12 @@ func (r *flyAppResource) Read(ctx context.Context, req resource.ReadRequest, res
 	}
 
 	data := flyAppResourceData{
-		Name:   types.StringValue(query.App.Name),
-		Org:    types.StringValue(query.App.Organization.Slug),
-		OrgId:  types.StringValue(query.App.Organization.Id),
-		AppUrl: types.StringValue(query.App.AppUrl),
-		Id:     types.StringValue(query.App.Id),
+		Name:     types.StringValue(query.App.Name),
+		Org:      types.StringValue(query.App.Organization.Slug),
+		OrgId:    types.StringValue(query.App.Organization.Id),
+		AppUrl:   types.StringValue(query.App.AppUrl),
+		Id:       types.StringValue(query.App.Id),
+		Timeouts: state.Timeouts,
 	}
 
 	diags = resp.State.Set(ctx, &data)
@@ -187,6 +230,7 @@ func (r *flyAppResource) Update(ctx context.Context, req resource.UpdateRequest,
 		resp.Diagnostics.AddError("Can't mutate Name of existing app", "Can't switch name "+state.Name.ValueString()+" to "+plan.Name.ValueString())
 	}
 
+	state.Timeouts = plan.Timeouts
 	resp.State.Set(ctx, state)
 
 	if resp.Diagnostics.HasError() {
@@ -199,6 +243,17 @@ func (r flyAppResource) Delete(ctx context.Context, req resource.DeleteRequest,
 
 	diags := req.State.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	deleteTimeout, diags := data.Timeouts.Delete(ctx, r.timeouts.Delete)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, deleteTimeout)
+	defer cancel()
 
 	_, err := graphql.DeleteAppMutation(ctx, *r.client, data.Name.ValueString())
 	var errList gqlerror.List
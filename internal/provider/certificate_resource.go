@@ -6,6 +6,7 @@ import (
 	"fmt"
 	basegql "github.com/Khan/genqlient/graphql"
 	"github.com/fly-apps/terraform-provider-fly/graphql"
+	"github.com/hashicorp/terraform-plugin-framework-timeouts/resource/timeouts"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
@@ -20,7 +21,8 @@ var _ resource.ResourceWithConfigure = &flyCertResource{}
 var _ resource.ResourceWithImportState = &flyCertResource{}
 
 type flyCertResource struct {
-	client *basegql.Client
+	client   *basegql.Client
+	timeouts resourceTimeouts
 }
 
 func NewCertResource() resource.Resource {
@@ -38,19 +40,21 @@ func (r *flyCertResource) Configure(_ context.Context, req resource.ConfigureReq
 
 	config := req.ProviderData.(ProviderConfig)
 	r.client = config.gqclient
+	r.timeouts = config.timeouts
 }
 
 type flyCertResourceData struct {
-	Id                        types.String `tfsdk:"id"`
-	Appid                     types.String `tfsdk:"app"`
-	Dnsvalidationinstructions types.String `tfsdk:"dnsvalidationinstructions"`
-	Dnsvalidationhostname     types.String `tfsdk:"dnsvalidationhostname"`
-	Dnsvalidationtarget       types.String `tfsdk:"dnsvalidationtarget"`
-	Hostname                  types.String `tfsdk:"hostname"`
-	Check                     types.Bool   `tfsdk:"check"`
+	Id                        types.String   `tfsdk:"id"`
+	Appid                     types.String   `tfsdk:"app"`
+	Dnsvalidationinstructions types.String   `tfsdk:"dnsvalidationinstructions"`
+	Dnsvalidationhostname     types.String   `tfsdk:"dnsvalidationhostname"`
+	Dnsvalidationtarget       types.String   `tfsdk:"dnsvalidationtarget"`
+	Hostname                  types.String   `tfsdk:"hostname"`
+	Check                     types.Bool     `tfsdk:"check"`
+	Timeouts                  timeouts.Value `tfsdk:"timeouts"`
 }
 
-func (r *flyCertResource) Schema(_ context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
+func (r *flyCertResource) Schema(ctx context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
 	resp.Schema = schema.Schema{
 		MarkdownDescription: "Fly certificate resource",
 		Attributes: map[string]schema.Attribute{
@@ -83,6 +87,14 @@ func (r *flyCertResource) Schema(_ context.Context, _ resource.SchemaRequest, re
 				Required:            true,
 			},
 		},
+		Blocks: map[string]schema.Block{
+			"timeouts": timeouts.Block(ctx, timeouts.Opts{
+				Create: true,
+				Read:   true,
+				Update: true,
+				Delete: true,
+			}),
+		},
 	}
 }
 
@@ -91,6 +103,17 @@ func (r *flyCertResource) Create(ctx context.Context, req resource.CreateRequest
 
 	diags := req.Plan.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	createTimeout, diags := data.Timeouts.Create(ctx, r.timeouts.Create)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, createTimeout)
+	defer cancel()
 
 	q, err := graphql.AddCertificate(ctx, *r.client, data.Appid.ValueString(), data.Hostname.ValueString())
 	if err != nil {
@@ -106,6 +129,7 @@ func (r *flyCertResource) Create(ctx context.Context, req resource.CreateRequest
 		Dnsvalidationtarget:       types.StringValue(q.AddCertificate.Certificate.DnsValidationTarget),
 		Hostname:                  types.StringValue(q.AddCertificate.Certificate.Hostname),
 		Check:                     types.BoolValue(q.AddCertificate.Certificate.Check),
+		Timeouts:                  data.Timeouts,
 	}
 
 	tflog.Info(ctx, fmt.Sprintf("%+v", data))
@@ -122,6 +146,17 @@ func (r *flyCertResource) Read(ctx context.Context, req resource.ReadRequest, re
 
 	diags := req.State.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	readTimeout, diags := data.Timeouts.Read(ctx, r.timeouts.Read)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
 
 	hostname := data.Hostname.ValueString()
 	app := data.Appid.ValueString()
@@ -148,6 +183,7 @@ func (r *flyCertResource) Read(ctx context.Context, req resource.ReadRequest, re
 		Dnsvalidationtarget:       types.StringValue(query.App.Certificate.DnsValidationTarget),
 		Hostname:                  types.StringValue(query.App.Certificate.Hostname),
 		Check:                     types.BoolValue(query.App.Certificate.Check),
+		Timeouts:                  data.Timeouts,
 	}
 
 	diags = resp.State.Set(ctx, &data)
@@ -158,8 +194,21 @@ func (r *flyCertResource) Read(ctx context.Context, req resource.ReadRequest, re
 }
 
 func (cr *flyCertResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var plan, state flyCertResourceData
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &plan)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// timeouts are the only thing that can change in place
+	if plan.Appid.Equal(state.Appid) && plan.Hostname.Equal(state.Hostname) {
+		state.Timeouts = plan.Timeouts
+		resp.Diagnostics.Append(resp.State.Set(ctx, &state)...)
+		return
+	}
+
 	resp.Diagnostics.AddError("The fly api does not allow updating certs once created", "Try deleting and then recreating the cert with new options")
-	return
 	// We could maybe instead flag every attribute with RequiresReplace?
 }
 
@@ -168,6 +217,17 @@ func (r *flyCertResource) Delete(ctx context.Context, req resource.DeleteRequest
 
 	diags := req.State.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	deleteTimeout, diags := data.Timeouts.Delete(ctx, r.timeouts.Delete)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, deleteTimeout)
+	defer cancel()
 
 	_, err := graphql.DeleteCertificate(ctx, *r.client, data.Appid.ValueString(), data.Hostname.ValueString())
 	if err != nil {
@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tokenSource is where the provider found its API token
+type tokenSource struct {
+	token string
+	// name describes the source the same way for every source, for logs and diagnostics
+	name string
+}
+
+// errNoToken is returned by resolveToken when none of the sources has a token
+var errNoToken = errors.New("no token found in fly_api_token, FLY_API_TOKEN, FLY_ACCESS_TOKEN, token_file or the flyctl config file")
+
+// resolveToken walks the credential chain: the fly_api_token attribute, the FLY_API_TOKEN and FLY_ACCESS_TOKEN
+// env vars, the token_file attribute and finally the access token flyctl stores when logging in
+func resolveToken(attribute string, tokenFile string) (tokenSource, error) {
+	if attribute != "" {
+		return tokenSource{token: attribute, name: "the fly_api_token attribute"}, nil
+	}
+	for _, env := range []string{"FLY_API_TOKEN", "FLY_ACCESS_TOKEN"} {
+		if token := os.Getenv(env); token != "" {
+			return tokenSource{token: token, name: "the " + env + " env var"}, nil
+		}
+	}
+	if tokenFile != "" {
+		name := fmt.Sprintf("the token_file attribute (%s)", tokenFile)
+		content, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return tokenSource{}, fmt.Errorf("unable to read %s: %w", name, err)
+		}
+		token := strings.TrimSpace(string(content))
+		if token == "" {
+			return tokenSource{}, fmt.Errorf("%s is empty", name)
+		}
+		return tokenSource{token: token, name: name}, nil
+	}
+
+	configFile, token, err := flyctlToken()
+	name := fmt.Sprintf("the flyctl config file (%s)", configFile)
+	if err != nil {
+		return tokenSource{}, fmt.Errorf("unable to use %s: %w", name, err)
+	}
+	if token != "" {
+		return tokenSource{token: token, name: name}, nil
+	}
+	return tokenSource{}, errNoToken
+}
+
+// flyctlToken reads the access token from flyctl's config file, in FLY_CONFIG_DIR or ~/.fly. A missing file is not
+// an error, flyctl may just not be installed.
+func flyctlToken() (string, string, error) {
+	dir := os.Getenv("FLY_CONFIG_DIR")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", nil
+		}
+		dir = filepath.Join(home, ".fly")
+	}
+	configFile := filepath.Join(dir, "config.yml")
+
+	content, err := os.ReadFile(configFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return configFile, "", nil
+	} else if err != nil {
+		return configFile, "", err
+	}
+
+	var config struct {
+		AccessToken string `yaml:"access_token"`
+	}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return configFile, "", err
+	}
+	return configFile, strings.TrimSpace(config.AccessToken), nil
+}
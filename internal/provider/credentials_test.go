@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveTokenOrder(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("FLY_CONFIG_DIR", dir)
+	if err := os.WriteFile(filepath.Join(dir, "config.yml"), []byte("access_token: from-flyctl\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FLY_API_TOKEN", "from-api-env")
+	t.Setenv("FLY_ACCESS_TOKEN", "from-access-env")
+
+	expect := func(attribute string, file string, token string, name string) {
+		t.Helper()
+		source, err := resolveToken(attribute, file)
+		if err != nil {
+			t.Fatalf("expected a token, got %s", err)
+		}
+		if source.token != token || source.name != name {
+			t.Fatalf("expected %q from %s, got %q from %s", token, name, source.token, source.name)
+		}
+	}
+
+	expect("from-attribute", tokenFile, "from-attribute", "the fly_api_token attribute")
+	expect("", tokenFile, "from-api-env", "the FLY_API_TOKEN env var")
+	os.Unsetenv("FLY_API_TOKEN")
+	expect("", tokenFile, "from-access-env", "the FLY_ACCESS_TOKEN env var")
+	os.Unsetenv("FLY_ACCESS_TOKEN")
+	expect("", tokenFile, "from-file", "the token_file attribute ("+tokenFile+")")
+	expect("", "", "from-flyctl", "the flyctl config file ("+filepath.Join(dir, "config.yml")+")")
+}
+
+func TestResolveTokenNone(t *testing.T) {
+	t.Setenv("FLY_CONFIG_DIR", t.TempDir())
+	t.Setenv("FLY_API_TOKEN", "")
+	t.Setenv("FLY_ACCESS_TOKEN", "")
+
+	if _, err := resolveToken("", ""); !errors.Is(err, errNoToken) {
+		t.Fatalf("expected errNoToken, got %v", err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	_, err := resolveToken("", missing)
+	if err == nil || errors.Is(err, errNoToken) {
+		t.Fatalf("expected a missing token_file to be reported, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "the token_file attribute ("+missing+")") {
+		t.Fatalf("expected the error to name the source, got %q", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	basegql "github.com/Khan/genqlient/graphql"
 	"github.com/fly-apps/terraform-provider-fly/graphql"
+	"github.com/hashicorp/terraform-plugin-framework-timeouts/resource/timeouts"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
@@ -22,7 +23,8 @@ var _ resource.ResourceWithConfigure = &flyIpResource{}
 var _ resource.ResourceWithImportState = &flyIpResource{}
 
 type flyIpResource struct {
-	client *basegql.Client
+	client   *basegql.Client
+	timeouts resourceTimeouts
 }
 
 func NewIpResource() resource.Resource {
@@ -40,17 +42,19 @@ func (r *flyIpResource) Configure(_ context.Context, req resource.ConfigureReque
 
 	config := req.ProviderData.(ProviderConfig)
 	r.client = config.gqclient
+	r.timeouts = config.timeouts
 }
 
 type flyIpResourceData struct {
-	Id      types.String `tfsdk:"id"`
-	Appid   types.String `tfsdk:"app"`
-	Region  types.String `tfsdk:"region"`
-	Address types.String `tfsdk:"address"`
-	Type    types.String `tfsdk:"type"`
+	Id       types.String   `tfsdk:"id"`
+	Appid    types.String   `tfsdk:"app"`
+	Region   types.String   `tfsdk:"region"`
+	Address  types.String   `tfsdk:"address"`
+	Type     types.String   `tfsdk:"type"`
+	Timeouts timeouts.Value `tfsdk:"timeouts"`
 }
 
-func (r *flyIpResource) Schema(_ context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
+func (r *flyIpResource) Schema(ctx context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
 	resp.Schema = schema.Schema{
 		MarkdownDescription: "Fly ip resource",
 		Attributes: map[string]schema.Attribute{
@@ -77,6 +81,14 @@ func (r *flyIpResource) Schema(_ context.Context, _ resource.SchemaRequest, resp
 				Default:             stringdefault.StaticString("global"),
 			},
 		},
+		Blocks: map[string]schema.Block{
+			"timeouts": timeouts.Block(ctx, timeouts.Opts{
+				Create: true,
+				Read:   true,
+				Update: true,
+				Delete: true,
+			}),
+		},
 	}
 }
 
@@ -85,6 +97,17 @@ func (r *flyIpResource) Create(ctx context.Context, req resource.CreateRequest,
 
 	diags := req.Plan.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	createTimeout, diags := data.Timeouts.Create(ctx, r.timeouts.Create)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, createTimeout)
+	defer cancel()
 
 	tflog.Info(ctx, fmt.Sprintf("%+v", data))
 
@@ -96,11 +119,12 @@ func (r *flyIpResource) Create(ctx context.Context, req resource.CreateRequest,
 	}
 
 	data = flyIpResourceData{
-		Id:      types.StringValue(q.AllocateIpAddress.IpAddress.Id),
-		Appid:   types.StringValue(data.Appid.ValueString()),
-		Region:  types.StringValue(q.AllocateIpAddress.IpAddress.Region),
-		Type:    types.StringValue(string(q.AllocateIpAddress.IpAddress.Type)),
-		Address: types.StringValue(q.AllocateIpAddress.IpAddress.Address),
+		Id:       types.StringValue(q.AllocateIpAddress.IpAddress.Id),
+		Appid:    types.StringValue(data.Appid.ValueString()),
+		Region:   types.StringValue(q.AllocateIpAddress.IpAddress.Region),
+		Type:     types.StringValue(string(q.AllocateIpAddress.IpAddress.Type)),
+		Address:  types.StringValue(q.AllocateIpAddress.IpAddress.Address),
+		Timeouts: data.Timeouts,
 	}
 
 	tflog.Info(ctx, fmt.Sprintf("%+v", data))
@@ -117,6 +141,17 @@ func (r flyIpResource) Read(ctx context.Context, req resource.ReadRequest, resp
 
 	diags := req.State.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	readTimeout, diags := data.Timeouts.Read(ctx, r.timeouts.Read)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
 
 	addr := data.Address.ValueString()
 	app := data.Appid.ValueString()
@@ -138,11 +173,12 @@ func (r flyIpResource) Read(ctx context.Context, req resource.ReadRequest, resp
 	}
 
 	data = flyIpResourceData{
-		Id:      types.StringValue(query.App.IpAddress.Id),
-		Appid:   types.StringValue(data.Appid.ValueString()),
-		Region:  types.StringValue(query.App.IpAddress.Region),
-		Type:    types.StringValue(string(query.App.IpAddress.Type)),
-		Address: types.StringValue(query.App.IpAddress.Address),
+		Id:       types.StringValue(query.App.IpAddress.Id),
+		Appid:    types.StringValue(data.Appid.ValueString()),
+		Region:   types.StringValue(query.App.IpAddress.Region),
+		Type:     types.StringValue(string(query.App.IpAddress.Type)),
+		Address:  types.StringValue(query.App.IpAddress.Address),
+		Timeouts: data.Timeouts,
 	}
 
 	diags = resp.State.Set(ctx, &data)
@@ -153,8 +189,21 @@ func (r flyIpResource) Read(ctx context.Context, req resource.ReadRequest, resp
 }
 
 func (r *flyIpResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var plan, state flyIpResourceData
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &plan)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// timeouts are the only thing that can change in place
+	if plan.Appid.Equal(state.Appid) && plan.Type.Equal(state.Type) && plan.Region.Equal(state.Region) {
+		state.Timeouts = plan.Timeouts
+		resp.Diagnostics.Append(resp.State.Set(ctx, &state)...)
+		return
+	}
+
 	resp.Diagnostics.AddError("The fly api does not allow updating ips once created", "Try deleting and then recreating the ip with new options")
-	return
 }
 
 func (r *flyIpResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
@@ -162,6 +211,17 @@ func (r *flyIpResource) Delete(ctx context.Context, req resource.DeleteRequest,
 
 	diags := req.State.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	deleteTimeout, diags := data.Timeouts.Delete(ctx, r.timeouts.Delete)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, deleteTimeout)
+	defer cancel()
 
 	if !data.Id.IsUnknown() && !data.Id.IsNull() && data.Id.ValueString() != "" {
 		_, err := graphql.ReleaseIpAddress(ctx, *r.client, data.Id.ValueString())
@@ -0,0 +1,209 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/hashicorp/terraform-plugin-framework-timeouts/resource/timeouts"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/listplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/mapplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringdefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+var _ resource.Resource = &flyMachineExecResource{}
+var _ resource.ResourceWithConfigure = &flyMachineExecResource{}
+
+type flyMachineExecResource struct {
+	config ProviderConfig
+}
+
+func NewMachineExecResource() resource.Resource {
+	return &flyMachineExecResource{}
+}
+
+func (r *flyMachineExecResource) Metadata(_ context.Context, _ resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = "fly_machine_exec"
+}
+
+func (r *flyMachineExecResource) Configure(_ context.Context, req resource.ConfigureRequest, _ *resource.ConfigureResponse) {
+	if req.ProviderData == nil {
+		return
+	}
+	r.config = req.ProviderData.(ProviderConfig)
+}
+
+type flyMachineExecResourceData struct {
+	Id          types.String   `tfsdk:"id"`
+	App         types.String   `tfsdk:"app"`
+	MachineId   types.String   `tfsdk:"machine_id"`
+	Command     []string       `tfsdk:"command"`
+	Triggers    types.Map      `tfsdk:"triggers"`
+	ExecTimeout types.String   `tfsdk:"exec_timeout"`
+	Stdout      types.String   `tfsdk:"stdout"`
+	Stderr      types.String   `tfsdk:"stderr"`
+	ExitCode    types.Int64    `tfsdk:"exit_code"`
+	Timeouts    timeouts.Value `tfsdk:"timeouts"`
+}
+
+func (r *flyMachineExecResource) Schema(ctx context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Runs a command in a started machine, again whenever `triggers` or any other argument changes. The apply fails if the command exits with a non-zero code",
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				MarkdownDescription: "Identifies this run of the command",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"app": schema.StringAttribute{
+				MarkdownDescription: "fly app",
+				Required:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"machine_id": schema.StringAttribute{
+				MarkdownDescription: "Machine to run the command in",
+				Required:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"command": schema.ListAttribute{
+				MarkdownDescription: "Command and its arguments, run without a shell",
+				Required:            true,
+				ElementType:         types.StringType,
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.RequiresReplace(),
+				},
+			},
+			"triggers": schema.MapAttribute{
+				MarkdownDescription: "Arbitrary values that run the command again when they change",
+				Optional:            true,
+				ElementType:         types.StringType,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
+			},
+			"exec_timeout": schema.StringAttribute{
+				MarkdownDescription: "How long the command may run as a Go duration, bounded by the provider's `request_timeout`. Defaults to 60s",
+				Optional:            true,
+				Computed:            true,
+				Default:             stringdefault.StaticString("60s"),
+			},
+			"stdout": schema.StringAttribute{
+				MarkdownDescription: "Standard output of the command",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"stderr": schema.StringAttribute{
+				MarkdownDescription: "Standard error of the command",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"exit_code": schema.Int64Attribute{
+				MarkdownDescription: "Exit code of the command",
+				Computed:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.UseStateForUnknown(),
+				},
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"timeouts": timeouts.Block(ctx, timeouts.Opts{
+				Create: true,
+			}),
+		},
+	}
+}
+
+func (r *flyMachineExecResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data flyMachineExecResourceData
+
+	diags := req.Plan.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	createTimeout, diags := data.Timeouts.Create(ctx, r.config.timeouts.Create)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, createTimeout)
+	defer cancel()
+
+	execTimeout := parseDuration(&resp.Diagnostics, path.Root("exec_timeout"), data.ExecTimeout, time.Minute)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	res, err := r.config.machineAPI.Exec(ctx, data.App.ValueString(), data.MachineId.ValueString(), data.Command, execTimeout)
+	if apiv1.IsNotFound(err) {
+		resp.Diagnostics.AddError("Machine not found", fmt.Sprintf("Machine %s was not found in app %s", data.MachineId.ValueString(), data.App.ValueString()))
+		return
+	} else if err != nil {
+		resp.Diagnostics.AddError("Failed to run command", err.Error())
+		return
+	}
+
+	// a failed run is saved so it is tainted and runs again on the next apply
+	data.Id = types.StringValue(fmt.Sprintf("%s-%d", data.MachineId.ValueString(), time.Now().UnixNano()))
+	data.Stdout = types.StringValue(res.Stdout)
+	data.Stderr = types.StringValue(res.Stderr)
+	data.ExitCode = types.Int64Value(int64(res.ExitCode))
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+
+	if res.ExitCode != 0 {
+		resp.Diagnostics.AddError("Command failed", fmt.Sprintf("Command exited with code %d in machine %s: %s", res.ExitCode, data.MachineId.ValueString(), res.Stderr))
+	}
+}
+
+// Read keeps what Create recorded, there is nothing on the machine to look at
+func (r *flyMachineExecResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data flyMachineExecResourceData
+
+	diags := req.State.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+}
+
+// Update only sees exec_timeout and timeouts change, which don't run the command again
+func (r *flyMachineExecResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var plan flyMachineExecResourceData
+
+	diags := req.Plan.Get(ctx, &plan)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = resp.State.Set(ctx, &plan)
+	resp.Diagnostics.Append(diags...)
+}
+
+// Delete only forgets the run, a command can't be undone
+func (r *flyMachineExecResource) Delete(ctx context.Context, _ resource.DeleteRequest, resp *resource.DeleteResponse) {
+	resp.State.RemoveResource(ctx)
+}
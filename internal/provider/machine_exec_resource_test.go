@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-testing/helper/acctest"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+func TestAccFlyMachineExec(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineExecResourceConfig(rName, `["echo", "hello"]`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine_exec.testExec", "stdout", "hello\n"),
+					resource.TestCheckResourceAttr("fly_machine_exec.testExec", "exit_code", "0"),
+				),
+			},
+			{
+				Config:      testFlyMachineExecResourceConfig(rName, `["sh", "-c", "exit 2"]`),
+				ExpectError: regexp.MustCompile("exited with code 2"),
+			},
+		},
+	})
+}
+
+func testFlyMachineExecResourceConfig(name string, command string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app    = "%s"
+  region = "%s"
+  name   = "%s"
+  image  = "nginx"
+}
+
+resource "fly_machine_exec" "testExec" {
+  app        = "%s"
+  machine_id = fly_machine.testMachine.id
+  command    = %s
+}
+`, app, region, name, app, command)
+}
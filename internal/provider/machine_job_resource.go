@@ -0,0 +1,276 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/hashicorp/terraform-plugin-framework-timeouts/resource/timeouts"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/mapplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+var _ resource.Resource = &flyMachineJobResource{}
+var _ resource.ResourceWithConfigure = &flyMachineJobResource{}
+var _ resource.ResourceWithModifyPlan = &flyMachineJobResource{}
+
+type flyMachineJobResource struct {
+	config ProviderConfig
+}
+
+func NewMachineJobResource() resource.Resource {
+	return &flyMachineJobResource{}
+}
+
+func (r *flyMachineJobResource) Metadata(_ context.Context, _ resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = "fly_machine_job"
+}
+
+func (r *flyMachineJobResource) Configure(_ context.Context, req resource.ConfigureRequest, _ *resource.ConfigureResponse) {
+	if req.ProviderData == nil {
+		return
+	}
+	r.config = req.ProviderData.(ProviderConfig)
+}
+
+type flyMachineJobResourceData struct {
+	Id       types.String   `tfsdk:"id"`
+	App      types.String   `tfsdk:"app"`
+	Region   types.String   `tfsdk:"region"`
+	Image    types.String   `tfsdk:"image"`
+	Cmd      []string       `tfsdk:"cmd"`
+	Env      types.Map      `tfsdk:"env"`
+	Triggers types.Map      `tfsdk:"triggers"`
+	ExitCode types.Int64    `tfsdk:"exit_code"`
+	ExitedAt types.String   `tfsdk:"exited_at"`
+	Timeouts timeouts.Value `tfsdk:"timeouts"`
+}
+
+func (r *flyMachineJobResource) Schema(ctx context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Runs a command to completion on a throwaway machine, for example database migrations. The job runs again only when `triggers` changes, other arguments are updated in place for the next run, and the apply fails if it exits with a non-zero code",
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				MarkdownDescription: "ID of the machine that ran the job",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"app": schema.StringAttribute{
+				MarkdownDescription: "fly app",
+				Required:            true,
+			},
+			"region": schema.StringAttribute{
+				MarkdownDescription: "machine region, defaults to the provider's `default_region`",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"image": schema.StringAttribute{
+				MarkdownDescription: "docker image",
+				Required:            true,
+			},
+			"cmd": schema.ListAttribute{
+				MarkdownDescription: "Command to run, defaults to the image's",
+				Optional:            true,
+				ElementType:         types.StringType,
+			},
+			"env": schema.MapAttribute{
+				MarkdownDescription: "Environment variables for the job",
+				Optional:            true,
+				ElementType:         types.StringType,
+			},
+			"triggers": schema.MapAttribute{
+				MarkdownDescription: "Arbitrary values that run the job again when they change",
+				Optional:            true,
+				ElementType:         types.StringType,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
+			},
+			"exit_code": schema.Int64Attribute{
+				MarkdownDescription: "Exit code of the job",
+				Computed:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.UseStateForUnknown(),
+				},
+			},
+			"exited_at": schema.StringAttribute{
+				MarkdownDescription: "When the job exited, in RFC 3339 format",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"timeouts": timeouts.Block(ctx, timeouts.Opts{
+				Create: true,
+				Delete: true,
+			}),
+		},
+	}
+}
+
+// ModifyPlan shows the provider's default_region as region of new jobs that don't set one
+func (r *flyMachineJobResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	planProviderDefault(ctx, req, resp, "region", "default_region", r.config.defaultRegion)
+}
+
+func (r *flyMachineJobResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data flyMachineJobResourceData
+
+	diags := req.Plan.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	createTimeout, diags := data.Timeouts.Create(ctx, r.config.timeouts.Create)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, createTimeout)
+	defer cancel()
+
+	createReq := apiv1.MachineCreateOrUpdateRequest{
+		Region: data.Region.ValueString(),
+		Config: apiv1.MachineConfig{
+			Image: data.Image.ValueString(),
+			Init: apiv1.InitConfig{
+				Cmd: data.Cmd,
+			},
+			Env:         map[string]string{},
+			AutoDestroy: true,
+			Restart:     &apiv1.MachineRestart{Policy: "no"},
+			Metadata:    map[string]string{apiv1.MetadataPlatformVersion: apiv1.PlatformVersion},
+		},
+	}
+	if !data.Env.IsNull() && !data.Env.IsUnknown() {
+		resp.Diagnostics.Append(data.Env.ElementsAs(ctx, &createReq.Config.Env, false)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	machineAPI := r.config.machineAPI
+
+	var machine apiv1.MachineResponse
+	err := machineAPI.CreateMachine(ctx, createReq, data.App.ValueString(), &machine)
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to create job machine", err.Error())
+		return
+	}
+
+	// a job that doesn't finish is tainted, so the next apply cleans up the machine and runs it again
+	data.Id = types.StringValue(machine.ID)
+	data.ExitCode = types.Int64Null()
+	data.ExitedAt = types.StringNull()
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	exit, err := machineAPI.WaitForExit(ctx, data.App.ValueString(), machine.ID, machine.InstanceID)
+	if err != nil {
+		resp.Diagnostics.AddError("Job did not finish", err.Error())
+		return
+	}
+
+	data.ExitCode = types.Int64Value(int64(exit.ExitCode))
+	data.ExitedAt = types.StringValue(exit.ExitedAt.Format(time.RFC3339))
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+
+	if exit.ExitCode != 0 {
+		resp.Diagnostics.AddError("Job failed", fmt.Sprintf("Job machine %s exited with code %d", machine.ID, exit.ExitCode))
+	}
+}
+
+// Read keeps what Create recorded, the job's machine destroys itself once it is done
+func (r *flyMachineJobResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data flyMachineJobResourceData
+
+	diags := req.State.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+}
+
+// Update records new arguments without running the job again, only a change to triggers replaces it
+func (r *flyMachineJobResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var plan flyMachineJobResourceData
+
+	diags := req.Plan.Get(ctx, &plan)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = resp.State.Set(ctx, &plan)
+	resp.Diagnostics.Append(diags...)
+}
+
+func (r *flyMachineJobResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data flyMachineJobResourceData
+
+	diags := req.State.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	deleteTimeout, diags := data.Timeouts.Delete(ctx, r.config.timeouts.Delete)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, deleteTimeout)
+	defer cancel()
+
+	machineAPI := r.config.machineAPI
+
+	// finished jobs are already gone, only one that was interrupted still has a machine to clean up
+	var machine apiv1.MachineResponse
+	err := machineAPI.ReadMachine(ctx, data.App.ValueString(), data.Id.ValueString(), &machine)
+	if apiv1.IsNotFound(err) || (err == nil && machine.State == "destroyed") {
+		resp.State.RemoveResource(ctx)
+		return
+	} else if err != nil {
+		resp.Diagnostics.AddError("Failed to read job machine", err.Error())
+		return
+	}
+
+	lease, err := machineAPI.AcquireLease(ctx, data.App.ValueString(), data.Id.ValueString(), apiv1.DefaultLeaseTTL)
+	if apiv1.IsNotFound(err) {
+		resp.State.RemoveResource(ctx)
+		return
+	} else if err != nil {
+		addLeaseError(&resp.Diagnostics, err)
+		return
+	}
+	defer releaseLease(ctx, lease)
+
+	err = machineAPI.DeleteMachine(ctx, data.App.ValueString(), data.Id.ValueString(), lease.Nonce(), true)
+	if err != nil {
+		resp.Diagnostics.AddError("Job machine delete failed", err.Error())
+		return
+	}
+
+	resp.State.RemoveResource(ctx)
+}
@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+func TestAccFlyMachineJob(t *testing.T) {
+	t.Parallel()
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineJobResourceConfig("0", "1"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine_job.testJob", "exit_code", "0"),
+					resource.TestCheckResourceAttrSet("fly_machine_job.testJob", "exited_at"),
+				),
+			},
+			{
+				Config:   testFlyMachineJobResourceConfig("0", "1"),
+				PlanOnly: true,
+			},
+			{
+				// without a new trigger the changed command is saved but not run
+				Config: testFlyMachineJobResourceConfig("4", "1"),
+				Check:  resource.TestCheckResourceAttr("fly_machine_job.testJob", "exit_code", "0"),
+			},
+			{
+				Config:      testFlyMachineJobResourceConfig("3", "2"),
+				ExpectError: regexp.MustCompile("exited with code 3"),
+			},
+		},
+	})
+}
+
+func testFlyMachineJobResourceConfig(exitCode string, run string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine_job" "testJob" {
+  app    = "%s"
+  region = "%s"
+  image  = "alpine"
+  cmd    = ["sh", "-c", "exit %s"]
+  triggers = {
+    run = "%s"
+  }
+}
+`, app, region, exitCode, run)
+}
@@ -2,22 +2,48 @@ package provider
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"os"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
+	"github.com/hashicorp/terraform-plugin-framework-timeouts/resource/timeouts"
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/listvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/mapvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/booldefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/objectplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringdefault"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
 	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 )
 
 var _ resource.Resource = &flyMachineResource{}
 var _ resource.ResourceWithConfigure = &flyMachineResource{}
 var _ resource.ResourceWithImportState = &flyMachineResource{}
+var _ resource.ResourceWithModifyPlan = &flyMachineResource{}
+var _ resource.ResourceWithValidateConfig = &flyMachineResource{}
+
+// rollbackTimeout bounds restoring the previous config after a failed update, which runs on a fresh context
+// since the update usually failed by running out of time
+const rollbackTimeout = 5 * time.Minute
 
 type flyMachineResource struct {
 	config ProviderConfig
@@ -39,14 +65,99 @@ func (r *flyMachineResource) Configure(_ context.Context, req resource.Configure
 }
 
 type TfPort struct {
-	Port     types.Int64    `tfsdk:"port"`
-	Handlers []types.String `tfsdk:"handlers"`
+	Port        types.Int64    `tfsdk:"port"`
+	StartPort   types.Int64    `tfsdk:"start_port"`
+	EndPort     types.Int64    `tfsdk:"end_port"`
+	Handlers    []types.String `tfsdk:"handlers"`
+	ForceHTTPS  types.Bool     `tfsdk:"force_https"`
+	HTTPOptions *TfHTTPOptions `tfsdk:"http_options"`
+	TLSOptions  *TfTLSOptions  `tfsdk:"tls_options"`
+}
+
+type TfHTTPOptions struct {
+	Compress        types.Bool              `tfsdk:"compress"`
+	ResponseHeaders map[string]types.String `tfsdk:"response_headers"`
+	H2Backend       types.Bool              `tfsdk:"h2_backend"`
+}
+
+type TfTLSOptions struct {
+	ALPN     []types.String `tfsdk:"alpn"`
+	Versions []types.String `tfsdk:"versions"`
 }
 
 type TfService struct {
-	Ports        []TfPort     `tfsdk:"ports"`
-	Protocol     types.String `tfsdk:"protocol"`
-	InternalPort types.Int64  `tfsdk:"internal_port"`
+	Ports              []TfPort         `tfsdk:"ports"`
+	Protocol           types.String     `tfsdk:"protocol"`
+	InternalPort       types.Int64      `tfsdk:"internal_port"`
+	Checks             []TfMachineCheck `tfsdk:"checks"`
+	Concurrency        *TfConcurrency   `tfsdk:"concurrency"`
+	AutostopMachines   types.Bool       `tfsdk:"autostop_machines"`
+	AutostartMachines  types.Bool       `tfsdk:"autostart_machines"`
+	MinMachinesRunning types.Int64      `tfsdk:"min_machines_running"`
+}
+
+type TfConcurrency struct {
+	Type      types.String `tfsdk:"type"`
+	SoftLimit types.Int64  `tfsdk:"soft_limit"`
+	HardLimit types.Int64  `tfsdk:"hard_limit"`
+}
+
+type TfMachineCheck struct {
+	Type          types.String    `tfsdk:"type"`
+	Port          types.Int64     `tfsdk:"port"`
+	Interval      types.String    `tfsdk:"interval"`
+	Timeout       types.String    `tfsdk:"timeout"`
+	GracePeriod   types.String    `tfsdk:"grace_period"`
+	Method        types.String    `tfsdk:"method"`
+	Path          types.String    `tfsdk:"path"`
+	Protocol      types.String    `tfsdk:"protocol"`
+	TLSSkipVerify types.Bool      `tfsdk:"tls_skip_verify"`
+	Headers       []TfCheckHeader `tfsdk:"headers"`
+}
+
+type TfCheckHeader struct {
+	Name   types.String   `tfsdk:"name"`
+	Values []types.String `tfsdk:"values"`
+}
+
+type TfContainer struct {
+	Name         types.String             `tfsdk:"name"`
+	Image        types.String             `tfsdk:"image"`
+	Cmd          []string                 `tfsdk:"cmd"`
+	Entrypoint   []string                 `tfsdk:"entrypoint"`
+	Env          map[string]types.String  `tfsdk:"env"`
+	Files        []TfContainerFile        `tfsdk:"files"`
+	Healthchecks []TfContainerHealthcheck `tfsdk:"healthchecks"`
+	DependsOn    []TfContainerDependency  `tfsdk:"depends_on"`
+}
+
+type TfContainerFile struct {
+	GuestPath  types.String `tfsdk:"guest_path"`
+	RawValue   types.String `tfsdk:"raw_value"`
+	SecretName types.String `tfsdk:"secret_name"`
+}
+
+type TfContainerHealthcheck struct {
+	Name             types.String          `tfsdk:"name"`
+	Interval         types.Int64           `tfsdk:"interval"`
+	Timeout          types.Int64           `tfsdk:"timeout"`
+	GracePeriod      types.Int64           `tfsdk:"grace_period"`
+	FailureThreshold types.Int64           `tfsdk:"failure_threshold"`
+	Exec             []string              `tfsdk:"exec"`
+	TCPPort          types.Int64           `tfsdk:"tcp_port"`
+	HTTP             *TfContainerHTTPCheck `tfsdk:"http"`
+}
+
+type TfContainerHTTPCheck struct {
+	Port   types.Int64  `tfsdk:"port"`
+	Method types.String `tfsdk:"method"`
+	Path   types.String `tfsdk:"path"`
+	Scheme types.String `tfsdk:"scheme"`
+}
+
+type TfContainerDependency struct {
+	Name      types.String `tfsdk:"name"`
+	Condition types.String `tfsdk:"condition"`
 }
 
 type flyMachineResourceData struct {
@@ -66,6 +177,43 @@ type flyMachineResourceData struct {
 
 	Mounts   []TfMachineMount `tfsdk:"mounts"`
 	Services []TfService      `tfsdk:"services"`
+	Restart  types.Object     `tfsdk:"restart"`
+
+	Checks map[string]TfMachineCheck `tfsdk:"checks"`
+
+	Containers []TfContainer `tfsdk:"containers"`
+
+	Files        []TfMachineFile `tfsdk:"files"`
+	Metadata     types.Map       `tfsdk:"metadata"`
+	ProcessGroup types.String    `tfsdk:"process_group"`
+	Schedule     types.String    `tfsdk:"schedule"`
+	AutoDestroy  types.Bool      `tfsdk:"auto_destroy"`
+
+	WaitForState      types.String   `tfsdk:"wait_for_state"`
+	DesiredState      types.String   `tfsdk:"desired_state"`
+	WaitForChecks     types.Bool     `tfsdk:"wait_for_checks"`
+	RollbackOnFailure types.Bool     `tfsdk:"rollback_on_failure"`
+	State             types.String   `tfsdk:"state"`
+	ForceDestroy      types.Bool     `tfsdk:"force_destroy"`
+	Timeouts          timeouts.Value `tfsdk:"timeouts"`
+}
+
+type TfMachineRestart struct {
+	Policy     types.String `tfsdk:"policy"`
+	MaxRetries types.Int64  `tfsdk:"max_retries"`
+}
+
+var restartAttrTypes = map[string]attr.Type{
+	"policy":      types.StringType,
+	"max_retries": types.Int64Type,
+}
+
+type TfMachineFile struct {
+	GuestPath   types.String `tfsdk:"guest_path"`
+	RawValue    types.String `tfsdk:"raw_value"`
+	LocalPath   types.String `tfsdk:"local_path"`
+	SecretName  types.String `tfsdk:"secret_name"`
+	ContentHash types.String `tfsdk:"content_hash"`
 }
 
 type TfMachineMount struct {
@@ -75,7 +223,7 @@ type TfMachineMount struct {
 	Volume    types.String `tfsdk:"volume"`
 }
 
-func (r *flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
+func (r *flyMachineResource) Schema(ctx context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
 	resp.Schema = schema.Schema{
 		MarkdownDescription: "Fly machine resource",
 		Attributes: map[string]schema.Attribute{
@@ -88,9 +236,11 @@ func (r *flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest,
 				},
 			},
 			"region": schema.StringAttribute{
-				MarkdownDescription: "machine region",
-				Required:            true,
+				MarkdownDescription: "machine region, defaults to the provider's `default_region`",
+				Optional:            true,
+				Computed:            true,
 				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
 					stringplanmodifier.RequiresReplace(),
 				},
 			},
@@ -128,23 +278,176 @@ func (r *flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest,
 				ElementType:         types.StringType,
 			},
 			"image": schema.StringAttribute{
-				MarkdownDescription: "docker image",
-				Required:            true,
+				MarkdownDescription: "docker image, conflicts with `containers`",
+				Optional:            true,
+				Validators: []validator.String{
+					stringvalidator.ExactlyOneOf(path.MatchRoot("containers")),
+				},
+			},
+			"containers": schema.ListNestedAttribute{
+				MarkdownDescription: "Containers run side by side in the machine instead of a single `image`, e.g. an app with a log shipper or proxy next to it",
+				Optional:            true,
+				Validators: []validator.List{
+					listvalidator.SizeAtLeast(1),
+				},
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"name": schema.StringAttribute{
+							MarkdownDescription: "Container name, unique within the machine",
+							Required:            true,
+						},
+						"image": schema.StringAttribute{
+							MarkdownDescription: "docker image",
+							Required:            true,
+						},
+						"cmd": schema.ListAttribute{
+							MarkdownDescription: "cmd",
+							Optional:            true,
+							ElementType:         types.StringType,
+						},
+						"entrypoint": schema.ListAttribute{
+							MarkdownDescription: "image entrypoint",
+							Optional:            true,
+							ElementType:         types.StringType,
+						},
+						"env": schema.MapAttribute{
+							MarkdownDescription: "Environment variables of the container",
+							Optional:            true,
+							ElementType:         types.StringType,
+						},
+						"files": schema.ListNestedAttribute{
+							MarkdownDescription: "Files written into the container, each from exactly one of `raw_value` or `secret_name`",
+							Optional:            true,
+							NestedObject: schema.NestedAttributeObject{
+								Attributes: map[string]schema.Attribute{
+									"guest_path": schema.StringAttribute{
+										MarkdownDescription: "Where the file is written in the container",
+										Required:            true,
+									},
+									"raw_value": schema.StringAttribute{
+										MarkdownDescription: "Content of the file",
+										Optional:            true,
+										Sensitive:           true,
+										Validators: []validator.String{
+											stringvalidator.ExactlyOneOf(path.MatchRelative().AtParent().AtName("secret_name")),
+										},
+									},
+									"secret_name": schema.StringAttribute{
+										MarkdownDescription: "App secret holding the base64 encoded content",
+										Optional:            true,
+									},
+								},
+							},
+						},
+						"healthchecks": schema.ListNestedAttribute{
+							MarkdownDescription: "Health checks of the container, each probing with exactly one of `exec`, `tcp_port` or `http`",
+							Optional:            true,
+							NestedObject: schema.NestedAttributeObject{
+								Attributes: map[string]schema.Attribute{
+									"name": schema.StringAttribute{
+										Optional: true,
+									},
+									"interval": schema.Int64Attribute{
+										MarkdownDescription: "Seconds between checks",
+										Optional:            true,
+									},
+									"timeout": schema.Int64Attribute{
+										MarkdownDescription: "Seconds a check may take before it fails",
+										Optional:            true,
+									},
+									"grace_period": schema.Int64Attribute{
+										MarkdownDescription: "Seconds after the container starts during which failing checks are ignored",
+										Optional:            true,
+									},
+									"failure_threshold": schema.Int64Attribute{
+										MarkdownDescription: "Failed checks in a row before the container is unhealthy",
+										Optional:            true,
+									},
+									"exec": schema.ListAttribute{
+										MarkdownDescription: "Command run in the container, healthy when it exits with 0",
+										Optional:            true,
+										ElementType:         types.StringType,
+									},
+									"tcp_port": schema.Int64Attribute{
+										MarkdownDescription: "Port that must accept connections",
+										Optional:            true,
+										Validators: []validator.Int64{
+											int64validator.ExactlyOneOf(
+												path.MatchRelative().AtParent().AtName("exec"),
+												path.MatchRelative().AtParent().AtName("http"),
+											),
+										},
+									},
+									"http": schema.SingleNestedAttribute{
+										MarkdownDescription: "HTTP request that must succeed",
+										Optional:            true,
+										Attributes: map[string]schema.Attribute{
+											"port": schema.Int64Attribute{
+												Required: true,
+											},
+											"method": schema.StringAttribute{
+												Optional: true,
+											},
+											"path": schema.StringAttribute{
+												Optional: true,
+											},
+											"scheme": schema.StringAttribute{
+												MarkdownDescription: "`http` or `https`",
+												Optional:            true,
+												Validators: []validator.String{
+													stringvalidator.OneOf("http", "https"),
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+						"depends_on": schema.ListNestedAttribute{
+							MarkdownDescription: "Containers that must reach a condition before this one starts",
+							Optional:            true,
+							NestedObject: schema.NestedAttributeObject{
+								Attributes: map[string]schema.Attribute{
+									"name": schema.StringAttribute{
+										MarkdownDescription: "Name of another container in this machine",
+										Required:            true,
+									},
+									"condition": schema.StringAttribute{
+										MarkdownDescription: "One of `started`, `healthy` or `exited_successfully`",
+										Required:            true,
+										Validators: []validator.String{
+											stringvalidator.OneOf("started", "healthy", "exited_successfully"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
 			},
 			"cputype": schema.StringAttribute{
 				MarkdownDescription: "cpu type",
 				Computed:            true,
 				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
 			},
 			"cpus": schema.Int64Attribute{
 				MarkdownDescription: "cpu count",
 				Computed:            true,
 				Optional:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.UseStateForUnknown(),
+				},
 			},
 			"memorymb": schema.Int64Attribute{
 				MarkdownDescription: "memory mb",
 				Computed:            true,
 				Optional:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.UseStateForUnknown(),
+				},
 			},
 			"env": schema.MapAttribute{
 				MarkdownDescription: "Optional environment variables, keys and values must be strings",
@@ -176,6 +479,129 @@ func (r *flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest,
 					},
 				},
 			},
+			"restart": schema.SingleNestedAttribute{
+				MarkdownDescription: "What happens when the machine's process exits. Defaults to the platform's policy",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers: []planmodifier.Object{
+					objectplanmodifier.UseStateForUnknown(),
+				},
+				Attributes: map[string]schema.Attribute{
+					"policy": schema.StringAttribute{
+						MarkdownDescription: "One of `no`, `always` or `on-failure`",
+						Required:            true,
+						Validators: []validator.String{
+							stringvalidator.OneOf("no", "always", "on-failure"),
+						},
+					},
+					"max_retries": schema.Int64Attribute{
+						MarkdownDescription: "How often an `on-failure` machine is restarted before it is left stopped",
+						Optional:            true,
+						Computed:            true,
+						Validators: []validator.Int64{
+							int64validator.AtLeast(0),
+						},
+					},
+				},
+			},
+			"files": schema.ListNestedAttribute{
+				MarkdownDescription: "Files written into the machine at boot, each from exactly one of `raw_value`, `local_path` or `secret_name`",
+				Optional:            true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"guest_path": schema.StringAttribute{
+							MarkdownDescription: "Where the file is written in the machine",
+							Required:            true,
+						},
+						"raw_value": schema.StringAttribute{
+							MarkdownDescription: "Content of the file",
+							Optional:            true,
+							Sensitive:           true,
+							Validators: []validator.String{
+								stringvalidator.ExactlyOneOf(
+									path.MatchRelative().AtParent().AtName("local_path"),
+									path.MatchRelative().AtParent().AtName("secret_name"),
+								),
+							},
+						},
+						"local_path": schema.StringAttribute{
+							MarkdownDescription: "Local file the content is read from when planning",
+							Optional:            true,
+						},
+						"secret_name": schema.StringAttribute{
+							MarkdownDescription: "App secret holding the base64 encoded content",
+							Optional:            true,
+						},
+						"content_hash": schema.StringAttribute{
+							MarkdownDescription: "SHA256 of the content, changes to it are what updates the machine",
+							Computed:            true,
+						},
+					},
+				},
+			},
+			"metadata": schema.MapAttribute{
+				MarkdownDescription: "Machine metadata. `fly_platform_version` is managed by the provider and `fly_process_group` is set through `process_group`",
+				Optional:            true,
+				ElementType:         types.StringType,
+				Validators: []validator.Map{
+					mapvalidator.KeysAre(stringvalidator.NoneOf(apiv1.MetadataProcessGroup, apiv1.MetadataPlatformVersion)),
+				},
+			},
+			"process_group": schema.StringAttribute{
+				MarkdownDescription: "flyctl process group the machine belongs to, e.g. `app` or `worker`",
+				Optional:            true,
+			},
+			"schedule": schema.StringAttribute{
+				MarkdownDescription: "Run the machine `hourly`, `daily`, `weekly` or `monthly`. Combine with a `restart` policy of `no` for jobs",
+				Optional:            true,
+				Validators: []validator.String{
+					stringvalidator.OneOf("hourly", "daily", "weekly", "monthly"),
+				},
+			},
+			"auto_destroy": schema.BoolAttribute{
+				MarkdownDescription: "Destroy the machine once its process exits. A machine that destroyed itself is created again on the next apply. Defaults to `false`",
+				Optional:            true,
+				Computed:            true,
+				Default:             booldefault.StaticBool(false),
+			},
+			"wait_for_state": schema.StringAttribute{
+				MarkdownDescription: "State the machine must reach before create and update are considered done, one of `created`, `started` or `stopped`. `created` returns as soon as the API accepts the machine. Defaults to `started`",
+				Optional:            true,
+				Computed:            true,
+				Default:             stringdefault.StaticString("started"),
+				Validators: []validator.String{
+					stringvalidator.OneOf("created", "started", "stopped"),
+				},
+			},
+			"desired_state": schema.StringAttribute{
+				MarkdownDescription: "Whether the machine should be `started`, `stopped` or `suspended`. Create and update start, stop or suspend the machine to match and wait for that state instead of `wait_for_state`. Unset leaves the run state alone",
+				Optional:            true,
+				Validators: []validator.String{
+					stringvalidator.OneOf("started", "stopped", "suspended"),
+				},
+			},
+			"wait_for_checks": schema.BoolAttribute{
+				MarkdownDescription: "Fail create and update unless all health checks pass before the timeout. Only applies to started machines. Defaults to `false`",
+				Optional:            true,
+				Computed:            true,
+				Default:             booldefault.StaticBool(false),
+			},
+			"rollback_on_failure": schema.BoolAttribute{
+				MarkdownDescription: "Put the previous config back when an update doesn't reach the requested state or pass its health checks, and fail the apply without recording the new config. Implies `wait_for_checks`. Defaults to `false`",
+				Optional:            true,
+				Computed:            true,
+				Default:             booldefault.StaticBool(false),
+			},
+			"state": schema.StringAttribute{
+				MarkdownDescription: "The state the machine is actually in",
+				Computed:            true,
+			},
+			"force_destroy": schema.BoolAttribute{
+				MarkdownDescription: "Destroy the machine without stopping it gracefully first. Defaults to `false`",
+				Optional:            true,
+				Computed:            true,
+				Default:             booldefault.StaticBool(false),
+			},
 			"services": schema.ListNestedAttribute{
 				MarkdownDescription: "services",
 				Optional:            true,
@@ -187,14 +613,72 @@ func (r *flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest,
 							NestedObject: schema.NestedAttributeObject{
 								Attributes: map[string]schema.Attribute{
 									"port": schema.Int64Attribute{
-										MarkdownDescription: "External port",
-										Required:            true,
+										MarkdownDescription: "External port, conflicts with `start_port` and `end_port`",
+										Optional:            true,
+										Validators: []validator.Int64{
+											int64validator.ExactlyOneOf(path.MatchRelative().AtParent().AtName("start_port")),
+										},
+									},
+									"start_port": schema.Int64Attribute{
+										MarkdownDescription: "First port of an external port range",
+										Optional:            true,
+										Validators: []validator.Int64{
+											int64validator.AlsoRequires(path.MatchRelative().AtParent().AtName("end_port")),
+										},
+									},
+									"end_port": schema.Int64Attribute{
+										MarkdownDescription: "Last port of an external port range",
+										Optional:            true,
+										Validators: []validator.Int64{
+											int64validator.AlsoRequires(path.MatchRelative().AtParent().AtName("start_port")),
+										},
 									},
 									"handlers": schema.ListAttribute{
 										MarkdownDescription: "How the edge should process requests",
 										Optional:            true,
 										ElementType:         types.StringType,
 									},
+									"force_https": schema.BoolAttribute{
+										MarkdownDescription: "Redirect plain http requests to https. Defaults to `false`",
+										Optional:            true,
+										Computed:            true,
+										Default:             booldefault.StaticBool(false),
+									},
+									"http_options": schema.SingleNestedAttribute{
+										MarkdownDescription: "Options for the `http` handler",
+										Optional:            true,
+										Attributes: map[string]schema.Attribute{
+											"compress": schema.BoolAttribute{
+												MarkdownDescription: "Compress responses at the edge",
+												Optional:            true,
+											},
+											"response_headers": schema.MapAttribute{
+												MarkdownDescription: "Headers added to every response",
+												Optional:            true,
+												ElementType:         types.StringType,
+											},
+											"h2_backend": schema.BoolAttribute{
+												MarkdownDescription: "Talk HTTP/2 to the machine",
+												Optional:            true,
+											},
+										},
+									},
+									"tls_options": schema.SingleNestedAttribute{
+										MarkdownDescription: "Options for the `tls` handler",
+										Optional:            true,
+										Attributes: map[string]schema.Attribute{
+											"alpn": schema.ListAttribute{
+												MarkdownDescription: "ALPN protocols to offer, e.g. `h2` and `http/1.1`",
+												Optional:            true,
+												ElementType:         types.StringType,
+											},
+											"versions": schema.ListAttribute{
+												MarkdownDescription: "TLS versions to accept, e.g. `TLSv1.2` and `TLSv1.3`",
+												Optional:            true,
+												ElementType:         types.StringType,
+											},
+										},
+									},
 								},
 							},
 						},
@@ -206,6 +690,126 @@ func (r *flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest,
 							MarkdownDescription: "Port application listens on internally",
 							Required:            true,
 						},
+						"checks": schema.ListNestedAttribute{
+							MarkdownDescription: "Health checks the proxy uses to decide whether to route to this service",
+							Optional:            true,
+							NestedObject: schema.NestedAttributeObject{
+								Attributes: machineCheckAttributes(),
+							},
+						},
+						"concurrency": schema.SingleNestedAttribute{
+							MarkdownDescription: "Load the proxy routes to a single machine",
+							Optional:            true,
+							Attributes: map[string]schema.Attribute{
+								"type": schema.StringAttribute{
+									MarkdownDescription: "Whether limits count `connections` or `requests`",
+									Optional:            true,
+									Validators: []validator.String{
+										stringvalidator.OneOf("connections", "requests"),
+									},
+								},
+								"soft_limit": schema.Int64Attribute{
+									MarkdownDescription: "Load above which other machines are preferred",
+									Optional:            true,
+								},
+								"hard_limit": schema.Int64Attribute{
+									MarkdownDescription: "Load above which the machine gets no more traffic",
+									Optional:            true,
+								},
+							},
+						},
+						"autostop_machines": schema.BoolAttribute{
+							MarkdownDescription: "Let the proxy stop machines that are idle",
+							Optional:            true,
+						},
+						"autostart_machines": schema.BoolAttribute{
+							MarkdownDescription: "Let the proxy start stopped machines when requests come in",
+							Optional:            true,
+						},
+						"min_machines_running": schema.Int64Attribute{
+							MarkdownDescription: "How many machines autostop leaves running in the primary region",
+							Optional:            true,
+							Validators: []validator.Int64{
+								int64validator.AtLeast(0),
+							},
+						},
+					},
+				},
+			},
+			"checks": schema.MapNestedAttribute{
+				MarkdownDescription: "Named machine health checks",
+				Optional:            true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: machineCheckAttributes(),
+				},
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"timeouts": timeouts.Block(ctx, timeouts.Opts{
+				Create: true,
+				Read:   true,
+				Update: true,
+				Delete: true,
+			}),
+		},
+	}
+}
+
+// machineCheckAttributes describes a health check, shared by machine and service checks
+func machineCheckAttributes() map[string]schema.Attribute {
+	return map[string]schema.Attribute{
+		"type": schema.StringAttribute{
+			MarkdownDescription: "`tcp` or `http`",
+			Required:            true,
+			Validators: []validator.String{
+				stringvalidator.OneOf("tcp", "http"),
+			},
+		},
+		"port": schema.Int64Attribute{
+			MarkdownDescription: "Port to check",
+			Optional:            true,
+		},
+		"interval": schema.StringAttribute{
+			MarkdownDescription: "Time between checks as a Go duration",
+			Optional:            true,
+		},
+		"timeout": schema.StringAttribute{
+			MarkdownDescription: "How long a check may take before it fails as a Go duration",
+			Optional:            true,
+		},
+		"grace_period": schema.StringAttribute{
+			MarkdownDescription: "How long after the machine starts failing checks are ignored as a Go duration",
+			Optional:            true,
+		},
+		"method": schema.StringAttribute{
+			MarkdownDescription: "HTTP method of http checks",
+			Optional:            true,
+		},
+		"path": schema.StringAttribute{
+			MarkdownDescription: "Path requested by http checks",
+			Optional:            true,
+		},
+		"protocol": schema.StringAttribute{
+			MarkdownDescription: "`http` or `https` for http checks",
+			Optional:            true,
+		},
+		"tls_skip_verify": schema.BoolAttribute{
+			MarkdownDescription: "Don't verify the certificate of https checks. Defaults to `false`",
+			Optional:            true,
+			Computed:            true,
+			Default:             booldefault.StaticBool(false),
+		},
+		"headers": schema.ListNestedAttribute{
+			MarkdownDescription: "Headers sent with http checks",
+			Optional:            true,
+			NestedObject: schema.NestedAttributeObject{
+				Attributes: map[string]schema.Attribute{
+					"name": schema.StringAttribute{
+						Required: true,
+					},
+					"values": schema.ListAttribute{
+						Required:    true,
+						ElementType: types.StringType,
 					},
 				},
 			},
@@ -213,6 +817,114 @@ func (r *flyMachineResource) Schema(_ context.Context, _ resource.SchemaRequest,
 	}
 }
 
+func TfCheckToCheck(input TfMachineCheck) apiv1.MachineCheck {
+	var headers []apiv1.MachineCheckHeader
+	for _, h := range input.Headers {
+		var values []string
+		for _, v := range h.Values {
+			values = append(values, v.ValueString())
+		}
+		headers = append(headers, apiv1.MachineCheckHeader{
+			Name:   h.Name.ValueString(),
+			Values: values,
+		})
+	}
+	return apiv1.MachineCheck{
+		Type:          input.Type.ValueString(),
+		Port:          input.Port.ValueInt64(),
+		Interval:      input.Interval.ValueString(),
+		Timeout:       input.Timeout.ValueString(),
+		GracePeriod:   input.GracePeriod.ValueString(),
+		Method:        input.Method.ValueString(),
+		Path:          input.Path.ValueString(),
+		Protocol:      input.Protocol.ValueString(),
+		TLSSkipVerify: input.TLSSkipVerify.ValueBool(),
+		Headers:       headers,
+	}
+}
+
+func CheckToTfCheck(input apiv1.MachineCheck) TfMachineCheck {
+	var headers []TfCheckHeader
+	for _, h := range input.Headers {
+		var values []types.String
+		for _, v := range h.Values {
+			values = append(values, types.StringValue(v))
+		}
+		headers = append(headers, TfCheckHeader{
+			Name:   types.StringValue(h.Name),
+			Values: values,
+		})
+	}
+	check := TfMachineCheck{
+		Type:          optionalString(input.Type),
+		Port:          types.Int64Null(),
+		Interval:      optionalString(input.Interval),
+		Timeout:       optionalString(input.Timeout),
+		GracePeriod:   optionalString(input.GracePeriod),
+		Method:        optionalString(input.Method),
+		Path:          optionalString(input.Path),
+		Protocol:      optionalString(input.Protocol),
+		TLSSkipVerify: types.BoolValue(input.TLSSkipVerify),
+		Headers:       headers,
+	}
+	if input.Port != 0 {
+		check.Port = types.Int64Value(input.Port)
+	}
+	return check
+}
+
+// optionalString maps the empty values the API reports for unset fields to null
+func optionalString(value string) types.String {
+	if value == "" {
+		return types.StringNull()
+	}
+	return types.StringValue(value)
+}
+
+func optionalInt64(value int64) types.Int64 {
+	if value == 0 {
+		return types.Int64Null()
+	}
+	return types.Int64Value(value)
+}
+
+func stringValues(input []types.String) []string {
+	var values []string
+	for _, v := range input {
+		values = append(values, v.ValueString())
+	}
+	return values
+}
+
+func stringsToTf(input []string) []types.String {
+	var values []types.String
+	for _, v := range input {
+		values = append(values, types.StringValue(v))
+	}
+	return values
+}
+
+// keepDurations holds on to the configured spelling of durations the API reports normalized, "1m" comes back as "1m0s"
+func (c *TfMachineCheck) keepDurations(prior TfMachineCheck) {
+	c.Interval = sameDuration(prior.Interval, c.Interval)
+	c.Timeout = sameDuration(prior.Timeout, c.Timeout)
+	c.GracePeriod = sameDuration(prior.GracePeriod, c.GracePeriod)
+}
+
+func sameDuration(prior types.String, actual types.String) types.String {
+	if prior.IsNull() || prior.IsUnknown() || actual.IsNull() {
+		return actual
+	}
+	p, err := time.ParseDuration(prior.ValueString())
+	if err != nil {
+		return actual
+	}
+	if a, err := time.ParseDuration(actual.ValueString()); err == nil && a == p {
+		return prior
+	}
+	return actual
+}
+
 func TfServicesToServices(input []TfService) []apiv1.Service {
 	services := make([]apiv1.Service, 0)
 	for _, s := range input {
@@ -222,16 +934,55 @@ func TfServicesToServices(input []TfService) []apiv1.Service {
 			for _, k := range j.Handlers {
 				handlers = append(handlers, k.ValueString())
 			}
-			ports = append(ports, apiv1.Port{
-				Port:     j.Port.ValueInt64(),
-				Handlers: handlers,
-			})
+			port := apiv1.Port{
+				Port:       j.Port.ValueInt64(),
+				StartPort:  j.StartPort.ValueInt64(),
+				EndPort:    j.EndPort.ValueInt64(),
+				Handlers:   handlers,
+				ForceHTTPS: j.ForceHTTPS.ValueBool(),
+			}
+			if j.HTTPOptions != nil {
+				port.HTTPOptions = &apiv1.HTTPOptions{
+					Compress:  j.HTTPOptions.Compress.ValueBoolPointer(),
+					H2Backend: j.HTTPOptions.H2Backend.ValueBoolPointer(),
+				}
+				if j.HTTPOptions.ResponseHeaders != nil {
+					headers := map[string]interface{}{}
+					for name, value := range j.HTTPOptions.ResponseHeaders {
+						headers[name] = value.ValueString()
+					}
+					port.HTTPOptions.Response = &apiv1.HTTPResponseOptions{Headers: headers}
+				}
+			}
+			if j.TLSOptions != nil {
+				port.TLSOptions = &apiv1.TLSOptions{
+					ALPN:     stringValues(j.TLSOptions.ALPN),
+					Versions: stringValues(j.TLSOptions.Versions),
+				}
+			}
+			ports = append(ports, port)
 		}
-		services = append(services, apiv1.Service{
-			Ports:        ports,
-			Protocol:     s.Protocol.ValueString(),
-			InternalPort: s.InternalPort.ValueInt64(),
-		})
+		var checks []apiv1.MachineCheck
+		for _, c := range s.Checks {
+			checks = append(checks, TfCheckToCheck(c))
+		}
+		service := apiv1.Service{
+			Ports:              ports,
+			Protocol:           s.Protocol.ValueString(),
+			InternalPort:       s.InternalPort.ValueInt64(),
+			Checks:             checks,
+			Autostop:           s.AutostopMachines.ValueBoolPointer(),
+			Autostart:          s.AutostartMachines.ValueBoolPointer(),
+			MinMachinesRunning: s.MinMachinesRunning.ValueInt64Pointer(),
+		}
+		if s.Concurrency != nil {
+			service.Concurrency = &apiv1.ServiceConcurrency{
+				Type:      s.Concurrency.Type.ValueString(),
+				SoftLimit: s.Concurrency.SoftLimit.ValueInt64(),
+				HardLimit: s.Concurrency.HardLimit.ValueInt64(),
+			}
+		}
+		services = append(services, service)
 	}
 	return services
 }
@@ -245,76 +996,527 @@ func ServicesToTfServices(input []apiv1.Service) []TfService {
 			for _, k := range j.Handlers {
 				handlers = append(handlers, types.StringValue(k))
 			}
-			tfports = append(tfports, TfPort{
-				Port:     types.Int64Value(j.Port),
-				Handlers: handlers,
-			})
+			tfport := TfPort{
+				Port:       optionalInt64(j.Port),
+				StartPort:  optionalInt64(j.StartPort),
+				EndPort:    optionalInt64(j.EndPort),
+				Handlers:   handlers,
+				ForceHTTPS: types.BoolValue(j.ForceHTTPS),
+			}
+			if j.HTTPOptions != nil {
+				tfport.HTTPOptions = &TfHTTPOptions{
+					Compress:  types.BoolPointerValue(j.HTTPOptions.Compress),
+					H2Backend: types.BoolPointerValue(j.HTTPOptions.H2Backend),
+				}
+				if j.HTTPOptions.Response != nil && j.HTTPOptions.Response.Headers != nil {
+					tfport.HTTPOptions.ResponseHeaders = map[string]types.String{}
+					for name, value := range j.HTTPOptions.Response.Headers {
+						tfport.HTTPOptions.ResponseHeaders[name] = types.StringValue(fmt.Sprint(value))
+					}
+				}
+			}
+			if j.TLSOptions != nil {
+				tfport.TLSOptions = &TfTLSOptions{
+					ALPN:     stringsToTf(j.TLSOptions.ALPN),
+					Versions: stringsToTf(j.TLSOptions.Versions),
+				}
+			}
+			tfports = append(tfports, tfport)
 		}
-		tfservices = append(tfservices, TfService{
-			Ports:        tfports,
-			Protocol:     types.StringValue(s.Protocol),
-			InternalPort: types.Int64Value(s.InternalPort),
-		})
+		var tfchecks []TfMachineCheck
+		for _, c := range s.Checks {
+			tfchecks = append(tfchecks, CheckToTfCheck(c))
+		}
+		tfservice := TfService{
+			Ports:              tfports,
+			Protocol:           types.StringValue(s.Protocol),
+			InternalPort:       types.Int64Value(s.InternalPort),
+			Checks:             tfchecks,
+			AutostopMachines:   types.BoolPointerValue(s.Autostop),
+			AutostartMachines:  types.BoolPointerValue(s.Autostart),
+			MinMachinesRunning: types.Int64PointerValue(s.MinMachinesRunning),
+		}
+		if s.Concurrency != nil {
+			tfservice.Concurrency = &TfConcurrency{
+				Type:      optionalString(s.Concurrency.Type),
+				SoftLimit: optionalInt64(s.Concurrency.SoftLimit),
+				HardLimit: optionalInt64(s.Concurrency.HardLimit),
+			}
+		}
+		tfservices = append(tfservices, tfservice)
 	}
 	return tfservices
 }
 
-func (r *flyMachineResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
-	var data flyMachineResourceData
-
-	diags := req.Plan.Get(ctx, &data)
-	resp.Diagnostics.Append(diags...)
-	if resp.Diagnostics.HasError() {
-		return
+func TfContainersToContainers(input []TfContainer) []apiv1.ContainerConfig {
+	var containers []apiv1.ContainerConfig
+	for _, c := range input {
+		container := apiv1.ContainerConfig{
+			Name:       c.Name.ValueString(),
+			Image:      c.Image.ValueString(),
+			Cmd:        c.Cmd,
+			Entrypoint: c.Entrypoint,
+		}
+		if c.Env != nil {
+			container.Env = map[string]string{}
+			for name, value := range c.Env {
+				container.Env[name] = value.ValueString()
+			}
+		}
+		for _, f := range c.Files {
+			file := apiv1.MachineFile{
+				GuestPath:  f.GuestPath.ValueString(),
+				SecretName: f.SecretName.ValueString(),
+			}
+			if !f.RawValue.IsNull() {
+				file.RawValue = base64.StdEncoding.EncodeToString([]byte(f.RawValue.ValueString()))
+			}
+			container.Files = append(container.Files, file)
+		}
+		for _, h := range c.Healthchecks {
+			check := apiv1.ContainerHealthcheck{
+				Name:             h.Name.ValueString(),
+				Interval:         h.Interval.ValueInt64(),
+				Timeout:          h.Timeout.ValueInt64(),
+				GracePeriod:      h.GracePeriod.ValueInt64(),
+				FailureThreshold: h.FailureThreshold.ValueInt64(),
+			}
+			switch {
+			case h.Exec != nil:
+				check.Exec = &apiv1.ContainerExecHealthcheck{Command: h.Exec}
+			case h.HTTP != nil:
+				check.HTTP = &apiv1.ContainerHTTPHealthcheck{
+					Port:   h.HTTP.Port.ValueInt64(),
+					Method: h.HTTP.Method.ValueString(),
+					Path:   h.HTTP.Path.ValueString(),
+					Scheme: h.HTTP.Scheme.ValueString(),
+				}
+			default:
+				check.TCP = &apiv1.ContainerTCPHealthcheck{Port: h.TCPPort.ValueInt64()}
+			}
+			container.Healthchecks = append(container.Healthchecks, check)
+		}
+		for _, d := range c.DependsOn {
+			container.DependsOn = append(container.DependsOn, apiv1.ContainerDependency{
+				Name:      d.Name.ValueString(),
+				Condition: d.Condition.ValueString(),
+			})
+		}
+		containers = append(containers, container)
 	}
+	return containers
+}
 
-	services := TfServicesToServices(data.Services)
-	createReq := apiv1.MachineCreateOrUpdateRequest{
-		Name:   data.Name.ValueString(),
-		Region: data.Region.ValueString(),
-		Config: apiv1.MachineConfig{
-			Image:    data.Image.ValueString(),
-			Services: services,
-			Init: apiv1.InitConfig{
-				Cmd:        data.Cmd,
-				Entrypoint: data.Entrypoint,
-				Exec:       data.Exec,
-			},
+// ContainersToTfContainers maps containers back to resource data. prior is what the containers were configured as,
+// it fills in file contents the API doesn't report back.
+func ContainersToTfContainers(input []apiv1.ContainerConfig, prior []TfContainer) []TfContainer {
+	var tfcontainers []TfContainer
+	for _, c := range input {
+		var previous TfContainer
+		for _, p := range prior {
+			if p.Name.ValueString() == c.Name {
+				previous = p
+			}
+		}
+		tfcontainer := TfContainer{
+			Name:       types.StringValue(c.Name),
+			Image:      types.StringValue(c.Image),
+			Cmd:        c.Cmd,
+			Entrypoint: c.Entrypoint,
+		}
+		if len(c.Env) > 0 || previous.Env != nil {
+			tfcontainer.Env = map[string]types.String{}
+			for name, value := range c.Env {
+				tfcontainer.Env[name] = types.StringValue(value)
+			}
+		}
+		for i, f := range c.Files {
+			file := TfContainerFile{
+				GuestPath:  types.StringValue(f.GuestPath),
+				RawValue:   types.StringNull(),
+				SecretName: optionalString(f.SecretName),
+			}
+			if content, err := base64.StdEncoding.DecodeString(f.RawValue); err == nil && f.RawValue != "" {
+				file.RawValue = types.StringValue(string(content))
+			} else if f.SecretName == "" && i < len(previous.Files) {
+				file.RawValue = previous.Files[i].RawValue
+			}
+			tfcontainer.Files = append(tfcontainer.Files, file)
+		}
+		for _, h := range c.Healthchecks {
+			check := TfContainerHealthcheck{
+				Name:             optionalString(h.Name),
+				Interval:         optionalInt64(h.Interval),
+				Timeout:          optionalInt64(h.Timeout),
+				GracePeriod:      optionalInt64(h.GracePeriod),
+				FailureThreshold: optionalInt64(h.FailureThreshold),
+				TCPPort:          types.Int64Null(),
+			}
+			switch {
+			case h.Exec != nil:
+				check.Exec = h.Exec.Command
+			case h.HTTP != nil:
+				check.HTTP = &TfContainerHTTPCheck{
+					Port:   types.Int64Value(h.HTTP.Port),
+					Method: optionalString(h.HTTP.Method),
+					Path:   optionalString(h.HTTP.Path),
+					Scheme: optionalString(h.HTTP.Scheme),
+				}
+			case h.TCP != nil:
+				check.TCPPort = types.Int64Value(h.TCP.Port)
+			}
+			tfcontainer.Healthchecks = append(tfcontainer.Healthchecks, check)
+		}
+		for _, d := range c.DependsOn {
+			tfcontainer.DependsOn = append(tfcontainer.DependsOn, TfContainerDependency{
+				Name:      types.StringValue(d.Name),
+				Condition: types.StringValue(d.Condition),
+			})
+		}
+		tfcontainers = append(tfcontainers, tfcontainer)
+	}
+	return tfcontainers
+}
+
+// machineConfig builds the Machines API config from planned resource data
+func (data flyMachineResourceData) machineConfig(ctx context.Context) (apiv1.MachineConfig, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	config := apiv1.MachineConfig{
+		Image:    data.Image.ValueString(),
+		Services: TfServicesToServices(data.Services),
+		Init: apiv1.InitConfig{
+			Cmd:        data.Cmd,
+			Entrypoint: data.Entrypoint,
+			Exec:       data.Exec,
 		},
+		Env:        map[string]string{},
+		Containers: TfContainersToContainers(data.Containers),
 	}
 
 	if !data.Cpus.IsUnknown() {
-		createReq.Config.Guest.Cpus = int(data.Cpus.ValueInt64())
+		config.Guest.Cpus = int(data.Cpus.ValueInt64())
 	}
 	if !data.CpuType.IsUnknown() {
-		createReq.Config.Guest.CpuType = data.CpuType.ValueString()
+		config.Guest.CpuType = data.CpuType.ValueString()
 	}
 	if !data.MemoryMb.IsUnknown() {
-		createReq.Config.Guest.MemoryMb = int(data.MemoryMb.ValueInt64())
-	}
-
-	if !data.Env.IsUnknown() {
-		var env map[string]string
-		data.Env.ElementsAs(ctx, &env, false)
-		createReq.Config.Env = env
-	}
-	if len(data.Mounts) > 0 {
-		var mounts []apiv1.MachineMount
-		for _, m := range data.Mounts {
-			mounts = append(mounts, apiv1.MachineMount{
-				Encrypted: m.Encrypted.ValueBool(),
-				Path:      m.Path.ValueString(),
-				SizeGb:    int(m.SizeGb.ValueInt64()),
-				Volume:    m.Volume.ValueString(),
-			})
+		config.Guest.MemoryMb = int(data.MemoryMb.ValueInt64())
+	}
+	if !data.Env.IsNull() && !data.Env.IsUnknown() {
+		diags.Append(data.Env.ElementsAs(ctx, &config.Env, false)...)
+	}
+
+	config.Schedule = data.Schedule.ValueString()
+	config.AutoDestroy = data.AutoDestroy.ValueBool()
+
+	// flyctl only treats machines with a platform version as its own
+	config.Metadata = map[string]string{apiv1.MetadataPlatformVersion: apiv1.PlatformVersion}
+	if !data.Metadata.IsNull() && !data.Metadata.IsUnknown() {
+		diags.Append(data.Metadata.ElementsAs(ctx, &config.Metadata, false)...)
+		config.Metadata[apiv1.MetadataPlatformVersion] = apiv1.PlatformVersion
+	}
+	if !data.ProcessGroup.IsNull() && !data.ProcessGroup.IsUnknown() {
+		config.Metadata[apiv1.MetadataProcessGroup] = data.ProcessGroup.ValueString()
+	}
+
+	if len(data.Checks) > 0 {
+		config.Checks = map[string]apiv1.MachineCheck{}
+		for name, c := range data.Checks {
+			config.Checks[name] = TfCheckToCheck(c)
+		}
+	}
+
+	if !data.Restart.IsNull() && !data.Restart.IsUnknown() {
+		var restart TfMachineRestart
+		diags.Append(data.Restart.As(ctx, &restart, basetypes.ObjectAsOptions{})...)
+		config.Restart = &apiv1.MachineRestart{
+			Policy: restart.Policy.ValueString(),
+		}
+		if !restart.MaxRetries.IsUnknown() {
+			config.Restart.MaxRetries = int(restart.MaxRetries.ValueInt64())
+		}
+	}
+
+	for _, m := range data.Mounts {
+		config.Mounts = append(config.Mounts, apiv1.MachineMount{
+			Encrypted: m.Encrypted.ValueBool(),
+			Path:      m.Path.ValueString(),
+			SizeGb:    int(m.SizeGb.ValueInt64()),
+			Volume:    m.Volume.ValueString(),
+		})
+	}
+
+	return config, diags
+}
+
+// setFromMachine overwrites the attributes owned by the Machines API with what it reports for machine.
+// Attributes that only drive provider behaviour, such as wait_for_state or desired_state, are left as they are.
+func (data *flyMachineResourceData) setFromMachine(ctx context.Context, machine apiv1.MachineResponse) diag.Diagnostics {
+	env, diags := types.MapValueFrom(ctx, types.StringType, machine.Config.Env)
+
+	tfservices := ServicesToTfServices(machine.Config.Services)
+	if data.Services == nil && len(tfservices) == 0 {
+		tfservices = nil
+	}
+	for i := range tfservices {
+		if i >= len(data.Services) {
+			break
+		}
+		for j := range tfservices[i].Checks {
+			if j < len(data.Services[i].Checks) {
+				tfservices[i].Checks[j].keepDurations(data.Services[i].Checks[j])
+			}
+		}
+	}
+
+	var tfchecks map[string]TfMachineCheck
+	for name, c := range machine.Config.Checks {
+		if tfchecks == nil {
+			tfchecks = map[string]TfMachineCheck{}
+		}
+		check := CheckToTfCheck(c)
+		if prior, ok := data.Checks[name]; ok {
+			check.keepDurations(prior)
+		}
+		tfchecks[name] = check
+	}
+
+	data.Name = types.StringValue(machine.Name)
+	data.Region = types.StringValue(machine.Region)
+	data.Id = types.StringValue(machine.ID)
+	data.PrivateIP = types.StringValue(machine.PrivateIP)
+	// the containers carry the images of a multi-container machine
+	data.Containers = ContainersToTfContainers(machine.Config.Containers, data.Containers)
+	data.Image = types.StringValue(machine.Config.Image)
+	if data.Containers != nil {
+		data.Image = types.StringNull()
+	}
+	data.Cpus = types.Int64Value(int64(machine.Config.Guest.Cpus))
+	data.MemoryMb = types.Int64Value(int64(machine.Config.Guest.MemoryMb))
+	data.CpuType = types.StringValue(machine.Config.Guest.CpuType)
+	data.Cmd = machine.Config.Init.Cmd
+	data.Entrypoint = machine.Config.Init.Entrypoint
+	data.Exec = machine.Config.Init.Exec
+	data.Env = env
+	data.Services = tfservices
+	data.Checks = tfchecks
+	data.Schedule = optionalString(machine.Config.Schedule)
+	data.AutoDestroy = types.BoolValue(machine.Config.AutoDestroy)
+	diags.Append(data.setMetadata(ctx, machine.Config.Metadata)...)
+	data.State = types.StringValue(machine.State)
+
+	data.Restart = types.ObjectNull(restartAttrTypes)
+	if machine.Config.Restart != nil && machine.Config.Restart.Policy != "" {
+		restart, restartDiags := types.ObjectValueFrom(ctx, restartAttrTypes, TfMachineRestart{
+			Policy:     types.StringValue(machine.Config.Restart.Policy),
+			MaxRetries: types.Int64Value(int64(machine.Config.Restart.MaxRetries)),
+		})
+		diags.Append(restartDiags...)
+		data.Restart = restart
+	}
+
+	data.Mounts = nil
+	for _, m := range machine.Config.Mounts {
+		data.Mounts = append(data.Mounts, TfMachineMount{
+			Encrypted: types.BoolValue(m.Encrypted),
+			Path:      types.StringValue(m.Path),
+			SizeGb:    types.Int64Value(int64(m.SizeGb)),
+			Volume:    types.StringValue(m.Volume),
+		})
+	}
+
+	return diags
+}
+
+// fileHash identifies a file's content without keeping the content itself in the plan. Secrets are only known by name.
+func fileHash(content []byte, secretName string) string {
+	if secretName != "" {
+		content = []byte("secret:" + secretName)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// content returns what the file holds, reading local_path if that is where it comes from
+func (f TfMachineFile) content() ([]byte, error) {
+	if !f.LocalPath.IsNull() {
+		return os.ReadFile(f.LocalPath.ValueString())
+	}
+	return []byte(f.RawValue.ValueString()), nil
+}
+
+// machineFiles resolves the content of the configured files. It is kept out of machineConfig so that comparing
+// configs doesn't depend on local files that may have changed or gone away since they went into state.
+func (data flyMachineResourceData) machineFiles() ([]apiv1.MachineFile, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	var files []apiv1.MachineFile
+	for i, f := range data.Files {
+		file := apiv1.MachineFile{
+			GuestPath:  f.GuestPath.ValueString(),
+			SecretName: f.SecretName.ValueString(),
+		}
+		if f.SecretName.IsNull() {
+			content, err := f.content()
+			if err != nil {
+				diags.AddAttributeError(path.Root("files").AtListIndex(i).AtName("local_path"), "Unable to read file", err.Error())
+				continue
+			}
+			file.RawValue = base64.StdEncoding.EncodeToString(content)
+		}
+		files = append(files, file)
+	}
+	return files, diags
+}
+
+// filesChanged reports whether files were added, removed or have different content
+func filesChanged(plan []TfMachineFile, state []TfMachineFile) bool {
+	if len(plan) != len(state) {
+		return true
+	}
+	for i := range plan {
+		if !plan[i].GuestPath.Equal(state[i].GuestPath) || !plan[i].ContentHash.Equal(state[i].ContentHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshFileHashes records the hash of what the machine really has for each managed file, so that changes
+// made outside of terraform show up in the plan
+func (data *flyMachineResourceData) refreshFileHashes(files []apiv1.MachineFile) {
+	for i, f := range data.Files {
+		data.Files[i].ContentHash = types.StringNull()
+		for _, actual := range files {
+			if actual.GuestPath != f.GuestPath.ValueString() {
+				continue
+			}
+			switch {
+			case actual.SecretName != "":
+				data.Files[i].ContentHash = types.StringValue(fileHash(nil, actual.SecretName))
+			case actual.RawValue != "":
+				content, err := base64.StdEncoding.DecodeString(actual.RawValue)
+				if err == nil {
+					data.Files[i].ContentHash = types.StringValue(fileHash(content, ""))
+				}
+			default:
+				// the API didn't tell us the content
+				data.Files[i].ContentHash = f.ContentHash
+			}
+		}
+	}
+}
+
+// setMetadata splits the metadata keys the provider manages off from the user's metadata
+func (data *flyMachineResourceData) setMetadata(ctx context.Context, input map[string]string) diag.Diagnostics {
+	metadata := map[string]string{}
+	data.ProcessGroup = types.StringNull()
+	for key, value := range input {
+		switch key {
+		case apiv1.MetadataPlatformVersion:
+		case apiv1.MetadataProcessGroup:
+			data.ProcessGroup = types.StringValue(value)
+		default:
+			metadata[key] = value
 		}
-		createReq.Config.Mounts = mounts
 	}
 
-	machineAPI := apiv1.NewMachineAPI(r.config.httpClient, r.config.httpEndpoint)
+	if len(metadata) == 0 && data.Metadata.IsNull() {
+		data.Metadata = types.MapNull(types.StringType)
+		return nil
+	}
+	var diags diag.Diagnostics
+	data.Metadata, diags = types.MapValueFrom(ctx, types.StringType, metadata)
+	return diags
+}
+
+// waitForState waits for the machine to reach the state requested through wait_for_state, for as long as ctx allows.
+// "created" means the machine is done as soon as the API has accepted it.
+func (r *flyMachineResource) waitForState(ctx context.Context, data flyMachineResourceData, instanceID string) error {
+	state := data.WaitForState.ValueString()
+	if state == "" || state == "created" {
+		return nil
+	}
+	timeout := r.config.timeouts.Create
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	return r.config.machineAPI.WaitForState(ctx, data.App.ValueString(), data.Id.ValueString(), instanceID, state, timeout)
+}
+
+// settle brings the machine to desired_state, or waits for wait_for_state when there is none, and records the
+// state the machine ends up in. nonce is only used to change the run state.
+func (r *flyMachineResource) settle(ctx context.Context, data *flyMachineResourceData, instanceID string, nonce string) error {
+	var err error
+	if data.DesiredState.IsNull() {
+		err = r.waitForState(ctx, *data, instanceID)
+	} else {
+		err = r.config.machineAPI.SetState(ctx, data.App.ValueString(), data.Id.ValueString(), nonce, data.DesiredState.ValueString())
+	}
+	if err != nil {
+		return err
+	}
+
+	var machine apiv1.MachineResponse
+	if err := r.config.machineAPI.ReadMachine(ctx, data.App.ValueString(), data.Id.ValueString(), &machine); err != nil {
+		return err
+	}
+	data.State = types.StringValue(machine.State)
+	return nil
+}
+
+// waitForChecks waits for the health checks of a started machine to pass when wait_for_checks is set
+func (r *flyMachineResource) waitForChecks(ctx context.Context, data flyMachineResourceData) error {
+	if !data.WaitForChecks.ValueBool() && !data.RollbackOnFailure.ValueBool() {
+		return nil
+	}
+	if data.State.ValueString() != "started" {
+		return nil
+	}
+	timeout := r.config.timeouts.Create
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	return r.config.machineAPI.WaitForChecks(ctx, data.App.ValueString(), data.Id.ValueString(), timeout)
+}
+
+func (r *flyMachineResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data flyMachineResourceData
+
+	diags := req.Plan.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	createTimeout, diags := data.Timeouts.Create(ctx, r.config.timeouts.Create)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, createTimeout)
+	defer cancel()
+
+	config, diags := data.machineConfig(ctx)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	config.Files, diags = data.machineFiles()
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	createReq := apiv1.MachineCreateOrUpdateRequest{
+		Name:   data.Name.ValueString(),
+		Region: data.Region.ValueString(),
+		Config: config,
+	}
+
+	machineAPI := r.config.machineAPI
 
 	var newMachine apiv1.MachineResponse
-	err := machineAPI.CreateMachine(createReq, data.App.ValueString(), &newMachine)
+	err := machineAPI.CreateMachine(ctx, createReq, data.App.ValueString(), &newMachine)
 	if err != nil {
 		resp.Diagnostics.AddError("Failed to create machine", err.Error())
 		return
@@ -322,50 +1524,43 @@ func (r *flyMachineResource) Create(ctx context.Context, req resource.CreateRequ
 
 	tflog.Info(ctx, fmt.Sprintf("%+v", newMachine))
 
-	// env := utils.KVToTfMap(newMachine.Config.Env, types.StringType)
-	env, diags := types.MapValueFrom(ctx, types.StringType, newMachine.Config.Env)
-	resp.Diagnostics.Append(diags...)
+	resp.Diagnostics.Append(data.setFromMachine(ctx, newMachine)...)
 
-	tfservices := ServicesToTfServices(newMachine.Config.Services)
-
-	if data.Services == nil && len(tfservices) == 0 {
-		tfservices = nil
+	// the machine exists from here on, so it goes into state even if it never gets to the requested state.
+	// Terraform then marks it as tainted and replaces it on the next apply.
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
 	}
 
-	data = flyMachineResourceData{
-		Name:       types.StringValue(newMachine.Name),
-		Region:     types.StringValue(newMachine.Region),
-		Id:         types.StringValue(newMachine.ID),
-		App:        data.App,
-		PrivateIP:  types.StringValue(newMachine.PrivateIP),
-		Image:      types.StringValue(newMachine.Config.Image),
-		Cpus:       types.Int64Value(int64(newMachine.Config.Guest.Cpus)),
-		MemoryMb:   types.Int64Value(int64(newMachine.Config.Guest.MemoryMb)),
-		CpuType:    types.StringValue(newMachine.Config.Guest.CPUKind),
-		Cmd:        newMachine.Config.Init.Cmd,
-		Entrypoint: newMachine.Config.Init.Entrypoint,
-		Exec:       newMachine.Config.Init.Exec,
-		Env:        env,
-		Services:   tfservices,
-	}
-
-	if len(newMachine.Config.Mounts) > 0 {
-		var tfmounts []TfMachineMount
-		for _, m := range newMachine.Config.Mounts {
-			tfmounts = append(tfmounts, TfMachineMount{
-				Encrypted: types.BoolValue(m.Encrypted),
-				Path:      types.StringValue(m.Path),
-				SizeGb:    types.Int64Value(int64(m.SizeGb)),
-				Volume:    types.StringValue(m.Volume),
-			})
+	var nonce string
+	if !data.DesiredState.IsNull() {
+		// a new machine still reports created while it launches, which SetState would take for stopped, so let the
+		// launch finish before deciding whether to stop or suspend it
+		launchTimeout := createTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			launchTimeout = time.Until(deadline)
+		}
+		err = machineAPI.WaitForState(ctx, data.App.ValueString(), data.Id.ValueString(), newMachine.InstanceID, "started", launchTimeout)
+		if err != nil {
+			resp.Diagnostics.AddError("Machine did not reach the requested state", err.Error())
+			return
+		}
+
+		lease, err := machineAPI.AcquireLease(ctx, data.App.ValueString(), data.Id.ValueString(), apiv1.DefaultLeaseTTL)
+		if err != nil {
+			addLeaseError(&resp.Diagnostics, err)
+			return
 		}
-		data.Mounts = tfmounts
+		defer releaseLease(ctx, lease)
+		nonce = lease.Nonce()
 	}
 
-	err = machineAPI.WaitForMachine(data.App.ValueString(), data.Id.ValueString(), newMachine.InstanceID)
+	err = r.settle(ctx, &data, newMachine.InstanceID, nonce)
 	if err != nil {
-		//FIXME(?): For now we just assume that the orchestrator is in fact going to faithfully execute our request
-		tflog.Info(ctx, "Waiting errored")
+		resp.Diagnostics.AddError("Machine did not reach the requested state", err.Error())
+		return
 	}
 
 	diags = resp.State.Set(ctx, &data)
@@ -373,6 +1568,12 @@ func (r *flyMachineResource) Create(ctx context.Context, req resource.CreateRequ
 	if resp.Diagnostics.HasError() {
 		return
 	}
+
+	err = r.waitForChecks(ctx, data)
+	if err != nil {
+		resp.Diagnostics.AddError("Machine health checks did not pass", err.Error())
+		return
+	}
 }
 
 func (r *flyMachineResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
@@ -380,55 +1581,53 @@ func (r *flyMachineResource) Read(ctx context.Context, req resource.ReadRequest,
 
 	diags := req.State.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	readTimeout, diags := data.Timeouts.Read(ctx, r.config.timeouts.Read)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
 
-	machineAPI := apiv1.NewMachineAPI(r.config.httpClient, r.config.httpEndpoint)
+	machineAPI := r.config.machineAPI
 
 	var machine apiv1.MachineResponse
 
-	_, err := machineAPI.ReadMachine(data.App.ValueString(), data.Id.ValueString(), &machine)
+	err := machineAPI.ReadMachine(ctx, data.App.ValueString(), data.Id.ValueString(), &machine)
+	if apiv1.IsNotFound(err) || (err == nil && machine.State == "destroyed") {
+		// deleted outside of terraform, dropping it from state plans a recreate
+		tflog.Warn(ctx, "machine no longer exists, removing it from state", map[string]interface{}{"app": data.App.ValueString(), "id": data.Id.ValueString()})
+		resp.State.RemoveResource(ctx)
+		return
+	}
 	if err != nil {
-		resp.Diagnostics.AddError("Failed to create machine", err.Error())
+		resp.Diagnostics.AddError("Failed to read machine", fmt.Sprintf("Could not read machine %s in app %s: %s", data.Id.ValueString(), data.App.ValueString(), err))
 		return
 	}
 
-	// env := utils.KVToTfMap(machine.Config.Env, types.StringType)
-	env, diags := types.MapValueFrom(ctx, types.StringType, machine.Config.Env)
-	resp.Diagnostics.Append(diags...)
+	resp.Diagnostics.Append(data.setFromMachine(ctx, machine)...)
+	data.refreshFileHashes(machine.Config.Files)
 
-	tfservices := ServicesToTfServices(machine.Config.Services)
-
-	if data.Services == nil && len(tfservices) == 0 {
-		tfservices = nil
+	// imported machines have no value for these yet
+	if data.WaitForState.IsNull() {
+		data.WaitForState = types.StringValue("started")
 	}
-
-	data = flyMachineResourceData{
-		Name:       types.StringValue(machine.Name),
-		Id:         types.StringValue(machine.ID),
-		Region:     types.StringValue(machine.Region),
-		App:        data.App,
-		PrivateIP:  types.StringValue(machine.PrivateIP),
-		Image:      types.StringValue(machine.Config.Image),
-		Cpus:       types.Int64Value(int64(machine.Config.Guest.Cpus)),
-		MemoryMb:   types.Int64Value(int64(machine.Config.Guest.MemoryMb)),
-		CpuType:    types.StringValue(machine.Config.Guest.CPUKind),
-		Cmd:        machine.Config.Init.Cmd,
-		Entrypoint: machine.Config.Init.Entrypoint,
-		Exec:       machine.Config.Init.Exec,
-		Env:        env,
-		Services:   tfservices,
-	}
-
-	if len(machine.Config.Mounts) > 0 {
-		var tfmounts []TfMachineMount
-		for _, m := range machine.Config.Mounts {
-			tfmounts = append(tfmounts, TfMachineMount{
-				Encrypted: types.BoolValue(m.Encrypted),
-				Path:      types.StringValue(m.Path),
-				SizeGb:    types.Int64Value(int64(m.SizeGb)),
-				Volume:    types.StringValue(m.Volume),
-			})
-		}
-		data.Mounts = tfmounts
+	if data.ForceDestroy.IsNull() {
+		data.ForceDestroy = types.BoolValue(false)
+	}
+	if data.WaitForChecks.IsNull() {
+		data.WaitForChecks = types.BoolValue(false)
+	}
+	if data.RollbackOnFailure.IsNull() {
+		data.RollbackOnFailure = types.BoolValue(false)
+	}
+	// only managed run states can drift, an unset desired_state accepts whatever the machine is doing
+	if !data.DesiredState.IsNull() {
+		data.DesiredState = types.StringValue(apiv1.NormalizeState(machine.State))
 	}
 
 	diags = resp.State.Set(ctx, &data)
@@ -464,110 +1663,147 @@ func (r *flyMachineResource) Update(ctx context.Context, req resource.UpdateRequ
 		resp.Diagnostics.AddError("Can't mutate region of existing machine", "Can't switch region "+state.Name.ValueString()+" to "+plan.Name.ValueString())
 	}
 
-	services := TfServicesToServices(plan.Services)
+	updateTimeout, diags := plan.Timeouts.Update(ctx, r.config.timeouts.Update)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, updateTimeout)
+	defer cancel()
+
+	config, diags := plan.machineConfig(ctx)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
 	updateReq := apiv1.MachineCreateOrUpdateRequest{
 		Name:   plan.Name.ValueString(),
 		Region: state.Region.ValueString(),
-		Config: apiv1.MachineConfig{
-			Image:    plan.Image.ValueString(),
-			Services: services,
-			Init: apiv1.InitConfig{
-				Cmd:        plan.Cmd,
-				Entrypoint: plan.Entrypoint,
-				Exec:       plan.Exec,
-			},
-		},
+		Config: config,
 	}
 
-	if !plan.Cpus.IsUnknown() {
-		updateReq.Config.Guest.Cpus = int(plan.Cpus.ValueInt64())
+	machineApi := r.config.machineAPI
+
+	lease, err := machineApi.AcquireLease(ctx, state.App.ValueString(), state.Id.ValueString(), apiv1.DefaultLeaseTTL)
+	if err != nil {
+		addLeaseError(&resp.Diagnostics, err)
+		return
 	}
-	if !plan.CpuType.IsUnknown() {
-		updateReq.Config.Guest.CpuType = plan.CpuType.ValueString()
+	defer releaseLease(ctx, lease)
+
+	stateConfig, diags := state.machineConfig(ctx)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
 	}
-	if !plan.MemoryMb.IsUnknown() {
-		updateReq.Config.Guest.MemoryMb = int(plan.MemoryMb.ValueInt64())
+
+	var updatedMachine apiv1.MachineResponse
+
+	configChanged := !reflect.DeepEqual(config, stateConfig) || filesChanged(plan.Files, state.Files)
+	updateReq.Config.Files, diags = plan.machineFiles()
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
 	}
-	if plan.Env.IsNull() {
-		env := map[string]string{}
-		updateReq.Config.Env = env
-	} else if !plan.Env.IsUnknown() {
-		var env map[string]string
-		plan.Env.ElementsAs(ctx, &env, false)
-		updateReq.Config.Env = env
-	} else if !state.Env.IsUnknown() {
-		updateReq.Config.Env = map[string]string{}
+	rollback := configChanged && plan.RollbackOnFailure.ValueBool()
+
+	// the config the machine actually runs, not what state says, is what a rollback has to restore
+	var previous apiv1.MachineResponse
+	if rollback {
+		err = machineApi.ReadMachine(ctx, state.App.ValueString(), state.Id.ValueString(), &previous)
+		if err != nil {
+			resp.Diagnostics.AddError("Failed to read machine", fmt.Sprintf("Could not snapshot the config of machine %s for rollback: %s", state.Id.ValueString(), err))
+			return
+		}
 	}
 
-	if len(plan.Mounts) > 0 {
-		var mounts []apiv1.MachineMount
-		for _, m := range plan.Mounts {
-			mounts = append(mounts, apiv1.MachineMount{
-				Encrypted: m.Encrypted.ValueBool(),
-				Path:      m.Path.ValueString(),
-				SizeGb:    int(m.SizeGb.ValueInt64()),
-				Volume:    m.Volume.ValueString(),
-			})
-		}
-		updateReq.Config.Mounts = mounts
+	if !configChanged {
+		// nothing the machine runs has changed, so don't restart it just to change the run state
+		err = machineApi.ReadMachine(ctx, state.App.ValueString(), state.Id.ValueString(), &updatedMachine)
+	} else {
+		err = machineApi.UpdateMachine(ctx, updateReq, state.App.ValueString(), state.Id.ValueString(), lease.Nonce(), &updatedMachine)
+	}
+	if apiv1.IsLeaseHeld(err) {
+		resp.Diagnostics.AddError("Machine is locked by another operation", err.Error())
+		return
+	} else if apiv1.IsNotFound(err) {
+		resp.Diagnostics.AddError("Machine no longer exists", fmt.Sprintf("Machine %s was not found in app %s, it may have been destroyed outside of terraform", state.Id.ValueString(), state.App.ValueString()))
+		return
+	} else if err != nil {
+		resp.Diagnostics.AddError("Failed to update machine", err.Error())
+		return
 	}
 
-	machineApi := apiv1.NewMachineAPI(r.config.httpClient, r.config.httpEndpoint)
+	resp.Diagnostics.Append(plan.setFromMachine(ctx, updatedMachine)...)
 
-	var updatedMachine apiv1.MachineResponse
+	diags = resp.State.Set(ctx, plan)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
-	err := machineApi.UpdateMachine(updateReq, state.App.ValueString(), state.Id.ValueString(), &updatedMachine)
-	if err != nil {
-		resp.Diagnostics.AddError("Failed to update machine", err.Error())
+	if configChanged || !plan.DesiredState.IsNull() {
+		err = r.settle(ctx, &plan, updatedMachine.InstanceID, lease.Nonce())
+	} else {
+		// the machine wasn't touched, so there is nothing to wait for and it may well be stopped on purpose
+		plan.State = types.StringValue(updatedMachine.State)
+	}
+	if err != nil && rollback {
+		r.rollBack(resp, state, previous, lease.Nonce(), err)
+		return
+	} else if err != nil {
+		resp.Diagnostics.AddError("Machine did not reach the requested state", err.Error())
 		return
 	}
 
-	// env := utils.KVToTfMap(updatedMachine.Config.Env, types.StringType)
-	env, diags := types.MapValueFrom(ctx, types.StringType, updatedMachine.Config.Env)
+	diags = resp.State.Set(ctx, plan)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
-	tfservices := ServicesToTfServices(updatedMachine.Config.Services)
-
-	state = flyMachineResourceData{
-		Name:       types.StringValue(updatedMachine.Name),
-		Region:     types.StringValue(updatedMachine.Region),
-		Id:         types.StringValue(updatedMachine.ID),
-		App:        state.App,
-		PrivateIP:  types.StringValue(updatedMachine.PrivateIP),
-		Image:      types.StringValue(updatedMachine.Config.Image),
-		Cpus:       types.Int64Value(int64(updatedMachine.Config.Guest.Cpus)),
-		MemoryMb:   types.Int64Value(int64(updatedMachine.Config.Guest.MemoryMb)),
-		CpuType:    types.StringValue(updatedMachine.Config.Guest.CPUKind),
-		Cmd:        updatedMachine.Config.Init.Cmd,
-		Entrypoint: updatedMachine.Config.Init.Entrypoint,
-		Exec:       updatedMachine.Config.Init.Exec,
-		Env:        env,
-		Services:   tfservices,
-	}
-
-	if len(updatedMachine.Config.Mounts) > 0 {
-		var tfmounts []TfMachineMount
-		for _, m := range updatedMachine.Config.Mounts {
-			tfmounts = append(tfmounts, TfMachineMount{
-				Encrypted: types.BoolValue(m.Encrypted),
-				Path:      types.StringValue(m.Path),
-				SizeGb:    types.Int64Value(int64(m.SizeGb)),
-				Volume:    types.StringValue(m.Volume),
-			})
-		}
-		state.Mounts = tfmounts
+	err = r.waitForChecks(ctx, plan)
+	if err != nil && rollback {
+		r.rollBack(resp, state, previous, lease.Nonce(), err)
+		return
+	} else if err != nil {
+		resp.Diagnostics.AddError("Machine health checks did not pass", err.Error())
+		return
 	}
+}
 
-	err = machineApi.WaitForMachine(state.App.ValueString(), state.Id.ValueString(), updatedMachine.InstanceID)
-	if err != nil {
-		tflog.Info(ctx, "Waiting errored")
+// rollBack puts the config from before a failed update back on the machine. When that works state is reset to
+// what it was, otherwise it keeps the new config the machine is stuck with.
+func (r *flyMachineResource) rollBack(resp *resource.UpdateResponse, state flyMachineResourceData, previous apiv1.MachineResponse, nonce string, cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	machineAPI := r.config.machineAPI
+	restoreReq := apiv1.MachineCreateOrUpdateRequest{
+		Name:   previous.Name,
+		Region: previous.Region,
+		Config: previous.Config,
 	}
 
-	resp.State.Set(ctx, state)
-	if resp.Diagnostics.HasError() {
+	var restored apiv1.MachineResponse
+	err := machineAPI.UpdateMachine(ctx, restoreReq, state.App.ValueString(), state.Id.ValueString(), nonce, &restored)
+	if err == nil && previous.State == "started" {
+		err = machineAPI.WaitForState(ctx, state.App.ValueString(), state.Id.ValueString(), restored.InstanceID, "started", rollbackTimeout)
+	}
+	if err != nil {
+		resp.Diagnostics.AddError(
+			"Machine update failed and could not be rolled back",
+			fmt.Sprintf("The update of machine %s failed: %s\n\nRestoring its previous config failed as well: %s", state.Id.ValueString(), cause, err),
+		)
 		return
 	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, state)...)
+	resp.Diagnostics.AddError(
+		"Machine update rolled back",
+		fmt.Sprintf("The update of machine %s failed: %s\n\nThe machine was rolled back to its previous config and the new config was not saved to state.", state.Id.ValueString(), cause),
+	)
 }
 
 func (r *flyMachineResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
@@ -575,10 +1811,31 @@ func (r *flyMachineResource) Delete(ctx context.Context, req resource.DeleteRequ
 
 	diags := req.State.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
-	machineApi := apiv1.NewMachineAPI(r.config.httpClient, r.config.httpEndpoint)
+	deleteTimeout, diags := data.Timeouts.Delete(ctx, r.config.timeouts.Delete)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, deleteTimeout)
+	defer cancel()
 
-	err := machineApi.DeleteMachine(data.App.ValueString(), data.Id.ValueString(), 50)
+	machineApi := r.config.machineAPI
+
+	lease, err := machineApi.AcquireLease(ctx, data.App.ValueString(), data.Id.ValueString(), apiv1.DefaultLeaseTTL)
+	if apiv1.IsNotFound(err) {
+		resp.State.RemoveResource(ctx)
+		return
+	} else if err != nil {
+		addLeaseError(&resp.Diagnostics, err)
+		return
+	}
+	defer releaseLease(ctx, lease)
+
+	err = machineApi.DeleteMachine(ctx, data.App.ValueString(), data.Id.ValueString(), lease.Nonce(), data.ForceDestroy.ValueBool())
 
 	if err != nil {
 		resp.Diagnostics.AddError("Machine delete failed", err.Error())
@@ -591,6 +1848,84 @@ func (r *flyMachineResource) Delete(ctx context.Context, req resource.DeleteRequ
 	}
 }
 
+func addLeaseError(diags *diag.Diagnostics, err error) {
+	var heldErr *apiv1.LeaseHeldError
+	if errors.As(err, &heldErr) {
+		diags.AddError("Machine is locked by another operation", heldErr.Error())
+		return
+	}
+	diags.AddError("Failed to acquire machine lease", err.Error())
+}
+
+// releaseLease gives the machine lease back. Failing to do so only delays other writers until the lease expires, so it is logged rather than reported.
+func releaseLease(ctx context.Context, lease *apiv1.Lease) {
+	if err := lease.Release(); err != nil {
+		tflog.Warn(ctx, err.Error())
+	}
+}
+
+// ValidateConfig checks that containers are named uniquely and only depend on each other
+func (r *flyMachineResource) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var containers []TfContainer
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("containers"), &containers)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	names := map[string]bool{}
+	for i, c := range containers {
+		if c.Name.IsUnknown() {
+			return
+		}
+		if names[c.Name.ValueString()] {
+			resp.Diagnostics.AddAttributeError(path.Root("containers").AtListIndex(i).AtName("name"), "Duplicate container name", fmt.Sprintf("More than one container is named %q", c.Name.ValueString()))
+		}
+		names[c.Name.ValueString()] = true
+	}
+	for i, c := range containers {
+		for j, d := range c.DependsOn {
+			if d.Name.IsUnknown() {
+				continue
+			}
+			dependsOnPath := path.Root("containers").AtListIndex(i).AtName("depends_on").AtListIndex(j).AtName("name")
+			if d.Name.Equal(c.Name) {
+				resp.Diagnostics.AddAttributeError(dependsOnPath, "Invalid container dependency", fmt.Sprintf("Container %q can't depend on itself", c.Name.ValueString()))
+			} else if !names[d.Name.ValueString()] {
+				resp.Diagnostics.AddAttributeError(dependsOnPath, "Invalid container dependency", fmt.Sprintf("Container %q depends on %q, which is not defined in this machine", c.Name.ValueString(), d.Name.ValueString()))
+			}
+		}
+	}
+}
+
+func (r *flyMachineResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	if req.Plan.Raw.IsNull() {
+		return
+	}
+
+	planProviderDefault(ctx, req, resp, "region", "default_region", r.config.defaultRegion)
+
+	var files []TfMachineFile
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("files"), &files)...)
+	if resp.Diagnostics.HasError() || files == nil {
+		return
+	}
+
+	for i, f := range files {
+		if f.RawValue.IsUnknown() || f.LocalPath.IsUnknown() || f.SecretName.IsUnknown() {
+			files[i].ContentHash = types.StringUnknown()
+			continue
+		}
+		content, err := f.content()
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("files").AtListIndex(i).AtName("local_path"), "Unable to read file", err.Error())
+			continue
+		}
+		files[i].ContentHash = types.StringValue(fileHash(content, f.SecretName.ValueString()))
+	}
+
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("files"), files)...)
+}
+
 func (mr flyMachineResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
 	idParts := strings.Split(req.ID, ",")
 
@@ -1,10 +1,16 @@
 package provider
 
 import (
+	"context"
 	"fmt"
+	"github.com/fly-apps/terraform-provider-fly/internal/utils"
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
 	"github.com/hashicorp/terraform-plugin-testing/helper/acctest"
 	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/terraform"
+	hreq "github.com/imroc/req/v3"
 	"os"
+	"regexp"
 	"testing"
 )
 
@@ -20,7 +26,10 @@ func TestAccFlyMachineBase(t *testing.T) {
 		Steps: []resource.TestStep{
 			{
 				Config: testFlyMachineResourceConfig(rName),
-				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "name", rName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "name", rName),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "wait_for_state", "started"),
+				),
 			},
 			{
 				Config: testFlyMachineResourceUpdateConfig(rName),
@@ -182,6 +191,8 @@ resource "fly_machine" "testMachine" {
   cmd        = ["cmdText"]
   entrypoint = ["entrypointText"]
   exec       = ["execText"]
+  # the bogus entrypoint means this machine never boots
+  wait_for_state = "created"
 }
 `, app, region, name)
 }
@@ -309,3 +320,593 @@ resource "fly_machine" "testMachine" {
 }
 `, app, region)
 }
+
+func TestAccFlyMachineTimeouts(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceTimeoutsConfig(rName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "name", rName),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "timeouts.create", "10m"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "force_destroy", "true"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceTimeoutsConfig(name string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app    = "%s"
+  region = "%s"
+  name   = "%s"
+  image  = "nginx"
+
+  force_destroy = true
+
+  timeouts {
+    create = "10m"
+    delete = "5m"
+  }
+}
+`, app, region, name)
+}
+
+func TestAccFlyMachineStoppedTimeoutsOnly(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceStoppedTimeoutsConfig(rName, `desired_state = "stopped"`, "10m"),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "state", "stopped"),
+			},
+			{
+				Config: testFlyMachineResourceStoppedTimeoutsConfig(rName, "", "5m"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "state", "stopped"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "timeouts.create", "5m"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceStoppedTimeoutsConfig(name string, desiredState string, create string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app    = "%s"
+  region = "%s"
+  name   = "%s"
+  image  = "nginx"
+  %s
+
+  timeouts {
+    create = "%s"
+  }
+}
+`, app, region, name, desiredState, create)
+}
+
+func TestAccFlyMachineDeletedOutOfBand(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	var machineID string
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceNoServicesConfig(rName),
+				Check: func(s *terraform.State) error {
+					machineID = s.RootModule().Resources["fly_machine.testMachine"].Primary.ID
+					return nil
+				},
+			},
+			{
+				PreConfig: func() {
+					client := hreq.C().SetCommonHeader("Authorization", utils.AuthorizationHeader(os.Getenv("FLY_API_TOKEN")))
+					endpoint, err := apiv1.ParseEndpoint(FLY_MACHINES_ENDPOINT)
+					if err != nil {
+						t.Fatal(err)
+					}
+					api := apiv1.NewMachineAPI(client, endpoint)
+					lease, err := api.AcquireLease(context.Background(), app, machineID, apiv1.DefaultLeaseTTL)
+					if err != nil {
+						t.Fatalf("failed to lease machine: %s", err)
+					}
+					defer lease.Release()
+					if err := api.DeleteMachine(context.Background(), app, machineID, lease.Nonce(), true); err != nil {
+						t.Fatalf("failed to delete machine out of band: %s", err)
+					}
+				},
+				Config:             testFlyMachineResourceNoServicesConfig(rName),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+func TestAccFlyMachineDesiredState(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceDesiredStateConfig(rName, "stopped"),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "state", "stopped"),
+			},
+			{
+				Config: testFlyMachineResourceDesiredStateConfig(rName, "started"),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "state", "started"),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceDesiredStateConfig(name string, state string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app           = "%s"
+  region        = "%s"
+  name          = "%s"
+  image         = "nginx"
+  desired_state = "%s"
+}
+`, app, region, name, state)
+}
+
+func TestAccFlyMachineRestart(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceRestartConfig(rName, `{ policy = "on-failure", max_retries = 3 }`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "restart.policy", "on-failure"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "restart.max_retries", "3"),
+				),
+			},
+			{
+				Config: testFlyMachineResourceRestartConfig(rName, `{ policy = "always" }`),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "restart.policy", "always"),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceRestartConfig(name string, restart string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app     = "%s"
+  region  = "%s"
+  name    = "%s"
+  image   = "nginx"
+  restart = %s
+}
+`, app, region, name, restart)
+}
+
+func TestAccFlyMachineChecks(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceChecksConfig(rName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "checks.alive.type", "tcp"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "wait_for_checks", "true"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "checks.alive.interval", "1m"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "services.0.checks.0.path", "/"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "services.0.checks.0.headers.0.name", "Host"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceChecksConfig(name string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app    = "%s"
+  region = "%s"
+  name   = "%s"
+  image  = "nginx"
+
+  wait_for_checks = true
+
+  checks = {
+    alive = {
+      type     = "tcp"
+      port     = 80
+      interval = "1m"
+      timeout  = "5s"
+    }
+  }
+  services = [
+    {
+      ports = [
+        {
+          port     = 80
+          handlers = ["http"]
+        }
+      ]
+      "protocol" : "tcp",
+      "internal_port" : 80
+      checks = [
+        {
+          type         = "http"
+          interval     = "15s"
+          timeout      = "2s"
+          grace_period = "5s"
+          method       = "GET"
+          path         = "/"
+          protocol     = "http"
+          headers = [
+            {
+              name   = "Host"
+              values = ["example.com"]
+            }
+          ]
+        }
+      ]
+    }
+  ]
+}
+`, app, region, name)
+}
+
+func TestAccFlyMachineServiceOptions(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceServiceOptionsConfig(rName),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "services.0.autostop_machines", "true"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "services.0.concurrency.soft_limit", "20"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "services.0.ports.0.force_https", "true"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "services.0.ports.1.tls_options.alpn.0", "h2"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "services.1.ports.0.start_port", "8000"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceServiceOptionsConfig(name string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app    = "%s"
+  region = "%s"
+  name   = "%s"
+  image  = "nginx"
+  services = [
+    {
+      ports = [
+        {
+          port        = 80
+          handlers    = ["http"]
+          force_https = true
+        },
+        {
+          port     = 443
+          handlers = ["tls", "http"]
+          http_options = {
+            compress = true
+            response_headers = {
+              "X-Frame-Options" = "DENY"
+            }
+          }
+          tls_options = {
+            alpn     = ["h2", "http/1.1"]
+            versions = ["TLSv1.2", "TLSv1.3"]
+          }
+        }
+      ]
+      protocol             = "tcp"
+      internal_port        = 80
+      autostop_machines    = true
+      autostart_machines   = true
+      min_machines_running = 0
+      concurrency = {
+        type       = "requests"
+        soft_limit = 20
+        hard_limit = 25
+      }
+    },
+    {
+      ports = [
+        {
+          start_port = 8000
+          end_port   = 8010
+        }
+      ]
+      protocol      = "tcp"
+      internal_port = 8000
+    }
+  ]
+}
+`, app, region, name)
+}
+
+func TestAccFlyMachineRollbackOnFailure(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceRollbackConfig(rName, `["nginx", "-g", "daemon off;"]`),
+			},
+			{
+				// nginx never listens, so the check fails and the old command is put back
+				Config:      testFlyMachineResourceRollbackConfig(rName, `["sleep", "infinity"]`),
+				ExpectError: regexp.MustCompile("Machine update rolled back"),
+			},
+			{
+				Config:   testFlyMachineResourceRollbackConfig(rName, `["nginx", "-g", "daemon off;"]`),
+				PlanOnly: true,
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceRollbackConfig(name string, cmd string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app    = "%s"
+  region = "%s"
+  name   = "%s"
+  image  = "nginx"
+  cmd    = %s
+
+  rollback_on_failure = true
+
+  checks = {
+    alive = {
+      type     = "tcp"
+      port     = 80
+      interval = "5s"
+      timeout  = "2s"
+    }
+  }
+
+  timeouts {
+    update = "2m"
+  }
+}
+`, app, region, name, cmd)
+}
+
+func TestAccFlyMachineMetadata(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceMetadataConfig(rName, "worker"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "process_group", "worker"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "metadata.%", "1"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "metadata.team", "platform"),
+				),
+			},
+			{
+				Config: testFlyMachineResourceMetadataConfig(rName, "app"),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "process_group", "app"),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceMetadataConfig(name string, group string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app           = "%s"
+  region        = "%s"
+  name          = "%s"
+  image         = "nginx"
+  process_group = "%s"
+  metadata = {
+    team = "platform"
+  }
+}
+`, app, region, name, group)
+}
+
+func TestAccFlyMachineFiles(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	localPath := t.TempDir() + "/index.html"
+	writeFile := func(content string) func() {
+		return func() {
+			if err := os.WriteFile(localPath, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				PreConfig: writeFile("<h1>hello</h1>"),
+				Config:    testFlyMachineResourceFilesConfig(rName, localPath),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrSet("fly_machine.testMachine", "files.0.content_hash"),
+					resource.TestCheckResourceAttrSet("fly_machine.testMachine", "files.1.content_hash"),
+				),
+			},
+			{
+				// only the local file changes, the config stays the same
+				PreConfig:          writeFile("<h1>goodbye</h1>"),
+				Config:             testFlyMachineResourceFilesConfig(rName, localPath),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceFilesConfig(name string, localPath string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app    = "%s"
+  region = "%s"
+  name   = "%s"
+  image  = "nginx"
+  files = [
+    {
+      guest_path = "/etc/nginx/conf.d/extra.conf"
+      raw_value  = "# managed by terraform"
+    },
+    {
+      guest_path = "/usr/share/nginx/html/index.html"
+      local_path = "%s"
+    }
+  ]
+}
+`, app, region, name, localPath)
+}
+
+func TestAccFlyMachineSchedule(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config:      testFlyMachineResourceScheduleConfig(rName, "every-minute"),
+				ExpectError: regexp.MustCompile(`value must be one of`),
+			},
+			{
+				Config: testFlyMachineResourceScheduleConfig(rName, "daily"),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "schedule", "daily"),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceScheduleConfig(name string, schedule string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app      = "%s"
+  region   = "%s"
+  name     = "%s"
+  image    = "nginx"
+  schedule = "%s"
+  restart  = { policy = "no" }
+
+  wait_for_state = "created"
+}
+`, app, region, name, schedule)
+}
+
+func TestAccFlyMachineContainers(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config:      testFlyMachineResourceContainersConfig(rName, `image = "nginx"`, "app"),
+				ExpectError: regexp.MustCompile(`Invalid Attribute Combination`),
+			},
+			{
+				Config:      testFlyMachineResourceContainersConfig(rName, "", "db"),
+				ExpectError: regexp.MustCompile(`which is not defined in this machine`),
+			},
+			{
+				Config: testFlyMachineResourceContainersConfig(rName, "", "app"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckNoResourceAttr("fly_machine.testMachine", "image"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "containers.#", "2"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "containers.1.depends_on.0.name", "app"),
+					resource.TestCheckResourceAttr("fly_machine.testMachine", "containers.0.healthchecks.0.tcp_port", "80"),
+				),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceContainersConfig(name string, image string, dependsOn string) string {
+	return providerConfig() + fmt.Sprintf(`
+resource "fly_machine" "testMachine" {
+  app    = "%s"
+  region = "%s"
+  name   = "%s"
+  %s
+
+  containers = [
+    {
+      name         = "app"
+      image        = "nginx"
+      healthchecks = [{ tcp_port = 80 }]
+    },
+    {
+      name  = "shipper"
+      image = "busybox"
+      cmd   = ["sh", "-c", "tail -f /dev/null"]
+      env   = { TARGET = "logs.internal" }
+      files = [{ guest_path = "/etc/shipper.conf", raw_value = "level=info" }]
+      depends_on = [{ name = "%s", condition = "healthy" }]
+    },
+  ]
+}
+`, app, region, name, image, dependsOn)
+}
+
+func TestAccFlyMachineDefaultRegion(t *testing.T) {
+	t.Parallel()
+	rName := acctest.RandStringFromCharSet(10, acctest.CharSetAlphaNum)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		PreCheck:                 func() { testAccPreCheck(t) },
+		Steps: []resource.TestStep{
+			{
+				Config: testFlyMachineResourceDefaultRegionConfig(rName),
+				Check:  resource.TestCheckResourceAttr("fly_machine.testMachine", "region", region),
+			},
+		},
+	})
+}
+
+func testFlyMachineResourceDefaultRegionConfig(name string) string {
+	return fmt.Sprintf(`
+provider "fly" {
+  default_region = "%s"
+}
+
+resource "fly_machine" "testMachine" {
+  app   = "%s"
+  name  = "%s"
+  image = "nginx"
+}
+`, region, app, name)
+}
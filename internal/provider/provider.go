@@ -2,45 +2,124 @@ package provider
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/Khan/genqlient/graphql"
 	"github.com/fly-apps/terraform-provider-fly/internal/utils"
+	"github.com/fly-apps/terraform-provider-fly/pkg/apiv1"
 	hreq "github.com/imroc/req/v3"
 
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
 	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/provider"
 	"github.com/hashicorp/terraform-plugin-framework/provider/schema"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
 	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 )
 
-const FLY_MACHINES_ENDPOINT string = "api.machines.dev"
+const FLY_MACHINES_ENDPOINT string = apiv1.DefaultEndpoint
+
+const FLY_API_URL string = "https://api.fly.io/graphql"
 
 var _ provider.Provider = &flyProvider{}
 
+// defaultRequestTimeout bounds a single HTTP call to either Fly API
+const defaultRequestTimeout = 2 * time.Minute
+
 type ProviderConfig struct {
-	httpEndpoint string
-	gqclient     *graphql.Client
-	httpClient   *hreq.Client
+	gqclient   *graphql.Client
+	machineAPI *apiv1.MachineAPI
+	timeouts   resourceTimeouts
+	// defaultOrg and defaultRegion fill in org and region for resources that leave them unset, empty if not configured
+	defaultOrg    string
+	defaultRegion string
+}
+
+// resourceTimeouts are the operation deadlines used when a resource has no timeouts block of its own
+type resourceTimeouts struct {
+	Create time.Duration
+	Read   time.Duration
+	Update time.Duration
+	Delete time.Duration
+}
+
+var defaultResourceTimeouts = resourceTimeouts{
+	Create: 20 * time.Minute,
+	Read:   5 * time.Minute,
+	Update: 20 * time.Minute,
+	Delete: 20 * time.Minute,
 }
 
 type flyProvider struct {
 	configured   bool
 	version      string
 	token        string
-	httpEndpoint string
+	httpEndpoint *url.URL
 	client       *graphql.Client
 	httpClient   *hreq.Client
 }
 
 type flyProviderData struct {
 	FlyToken        types.String `tfsdk:"fly_api_token"`
+	TokenFile       types.String `tfsdk:"token_file"`
 	FlyHttpEndpoint types.String `tfsdk:"fly_http_endpoint"`
+	FlyAPIURL       types.String `tfsdk:"fly_api_url"`
+	CABundle        types.String `tfsdk:"ca_bundle"`
+	HTTPProxy       types.String `tfsdk:"http_proxy"`
+	MaxRetries      types.Int64  `tfsdk:"max_retries"`
+	RetryMinBackoff types.String `tfsdk:"retry_min_backoff"`
+	RetryMaxBackoff types.String `tfsdk:"retry_max_backoff"`
+	RequestTimeout  types.String `tfsdk:"request_timeout"`
+	DefaultOrg      types.String `tfsdk:"default_org"`
+	DefaultRegion   types.String `tfsdk:"default_region"`
+
+	DefaultTimeouts *flyProviderTimeoutsData `tfsdk:"default_timeouts"`
+}
+
+type flyProviderTimeoutsData struct {
+	Create types.String `tfsdk:"create"`
+	Read   types.String `tfsdk:"read"`
+	Update types.String `tfsdk:"update"`
+	Delete types.String `tfsdk:"delete"`
+}
+
+// planProviderDefault sets attr in the plan of a resource being created to the provider's default when the
+// configuration leaves it unset, so the value shows in the plan instead of being known after apply. Existing
+// resources keep what they have, attr should carry UseStateForUnknown.
+func planProviderDefault(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse, attr string, providerAttr string, def string) {
+	if req.Plan.Raw.IsNull() || !req.State.Raw.IsNull() {
+		return
+	}
+
+	var configured types.String
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root(attr), &configured)...)
+	if resp.Diagnostics.HasError() || !configured.IsNull() || def == "" {
+		return
+	}
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root(attr), def)...)
+}
+
+// parseDuration reads an optional duration attribute, falling back to def when it is not set
+func parseDuration(diags *diag.Diagnostics, attrPath path.Path, value types.String, def time.Duration) time.Duration {
+	if value.IsNull() || value.IsUnknown() {
+		return def
+	}
+	d, err := time.ParseDuration(value.ValueString())
+	if err != nil {
+		diags.AddAttributeError(attrPath, "Invalid duration", err.Error())
+		return def
+	}
+	return d
 }
 
 func (p *flyProvider) Metadata(_ context.Context, _ provider.MetadataRequest, resp *provider.MetadataResponse) {
@@ -56,26 +135,32 @@ func (p *flyProvider) Configure(ctx context.Context, req provider.ConfigureReque
 		return
 	}
 
-	var token string
-	if data.FlyToken.IsUnknown() {
+	if data.FlyToken.IsUnknown() || data.TokenFile.IsUnknown() {
 		resp.Diagnostics.AddWarning(
 			"Unable to create client",
 			"Cannot use unknown value as token",
 		)
 		return
 	}
-	if data.FlyToken.IsNull() {
-		token = os.Getenv("FLY_API_TOKEN")
-	} else {
-		token = data.FlyToken.ValueString()
-	}
-	if token == "" {
+	source, err := resolveToken(data.FlyToken.ValueString(), data.TokenFile.ValueString())
+	if err != nil {
 		resp.Diagnostics.AddError(
 			"Unable to find token",
-			"token cannot be an empty string",
+			err.Error(),
+		)
+		return
+	}
+	token := source.token
+	if strings.HasPrefix(strings.TrimSpace(token), "FlyV1 ") && len(utils.Macaroons(token)) == 0 {
+		resp.Diagnostics.AddError(
+			"Invalid token",
+			fmt.Sprintf("The token from %s uses the FlyV1 scheme but holds no macaroons", source.name),
 		)
 		return
 	}
+	tflog.Info(ctx, "Using Fly API token from "+source.name)
+	// the chain has several places to pick a token from, say which one won so a surprising token is easy to track down
+	resp.Diagnostics.AddWarning("Fly API token source", "Using the Fly API token from "+source.name)
 
 	p.token = token
 
@@ -87,7 +172,82 @@ func (p *flyProvider) Configure(ctx context.Context, req provider.ConfigureReque
 		httpEndpoint = endpoint
 	}
 
-	p.httpEndpoint = httpEndpoint
+	p.httpEndpoint, err = apiv1.ParseEndpoint(httpEndpoint)
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("fly_http_endpoint"), "Invalid Machines API endpoint", err.Error())
+		return
+	}
+	if apiv1.IsPlaintext(p.httpEndpoint) {
+		resp.Diagnostics.AddWarning("Machines API endpoint is not using https", fmt.Sprintf("Requests to %s, including the API token, are sent unencrypted", p.httpEndpoint))
+	}
+
+	apiURL := FLY_API_URL
+	if !data.FlyAPIURL.IsNull() && !data.FlyAPIURL.IsUnknown() {
+		apiURL = data.FlyAPIURL.ValueString()
+	} else if u, ok := os.LookupEnv("FLY_API_URL"); ok {
+		apiURL = u
+	}
+	graphqlURL, err := url.Parse(apiURL)
+	if err != nil || (graphqlURL.Scheme != "http" && graphqlURL.Scheme != "https") || graphqlURL.Host == "" {
+		resp.Diagnostics.AddAttributeError(path.Root("fly_api_url"), "Invalid GraphQL API URL", fmt.Sprintf("%q must be an http or https URL like %s", apiURL, FLY_API_URL))
+		return
+	}
+	if apiv1.IsPlaintext(graphqlURL) {
+		resp.Diagnostics.AddWarning("GraphQL API URL is not using https", fmt.Sprintf("Requests to %s, including the API token, are sent unencrypted", graphqlURL))
+	}
+
+	var rootCAs *x509.CertPool
+	if !data.CABundle.IsNull() && !data.CABundle.IsUnknown() {
+		caBundle, err := os.ReadFile(data.CABundle.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("ca_bundle"), "Unable to read CA bundle", err.Error())
+			return
+		}
+		// the bundle adds to the system roots rather than replacing them
+		rootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			resp.Diagnostics.AddAttributeError(path.Root("ca_bundle"), "Invalid CA bundle", fmt.Sprintf("%s does not contain any PEM encoded certificates", data.CABundle.ValueString()))
+			return
+		}
+	}
+
+	var httpProxy string
+	if !data.HTTPProxy.IsNull() && !data.HTTPProxy.IsUnknown() {
+		httpProxy = data.HTTPProxy.ValueString()
+		proxyURL, err := url.Parse(httpProxy)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			resp.Diagnostics.AddAttributeError(path.Root("http_proxy"), "Invalid proxy URL", fmt.Sprintf("%q must be a URL like http://proxy.example:3128", httpProxy))
+			return
+		}
+	}
+
+	retryPolicy := apiv1.DefaultRetryPolicy
+	if !data.MaxRetries.IsNull() && !data.MaxRetries.IsUnknown() {
+		retryPolicy.MaxRetries = int(data.MaxRetries.ValueInt64())
+	}
+	retryPolicy.MinBackoff = parseDuration(&resp.Diagnostics, path.Root("retry_min_backoff"), data.RetryMinBackoff, retryPolicy.MinBackoff)
+	retryPolicy.MaxBackoff = parseDuration(&resp.Diagnostics, path.Root("retry_max_backoff"), data.RetryMaxBackoff, retryPolicy.MaxBackoff)
+	if retryPolicy.MaxBackoff < retryPolicy.MinBackoff {
+		resp.Diagnostics.AddAttributeError(path.Root("retry_max_backoff"), "Invalid retry backoff", "retry_max_backoff must not be lower than retry_min_backoff")
+	}
+
+	requestTimeout := parseDuration(&resp.Diagnostics, path.Root("request_timeout"), data.RequestTimeout, defaultRequestTimeout)
+
+	timeouts := defaultResourceTimeouts
+	if data.DefaultTimeouts != nil {
+		timeoutsPath := path.Root("default_timeouts")
+		timeouts.Create = parseDuration(&resp.Diagnostics, timeoutsPath.AtName("create"), data.DefaultTimeouts.Create, timeouts.Create)
+		timeouts.Read = parseDuration(&resp.Diagnostics, timeoutsPath.AtName("read"), data.DefaultTimeouts.Read, timeouts.Read)
+		timeouts.Update = parseDuration(&resp.Diagnostics, timeoutsPath.AtName("update"), data.DefaultTimeouts.Update, timeouts.Update)
+		timeouts.Delete = parseDuration(&resp.Diagnostics, timeoutsPath.AtName("delete"), data.DefaultTimeouts.Delete, timeouts.Delete)
+	}
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
 	enableTracing := false
 	_, ok := os.LookupEnv("DEBUG")
@@ -103,19 +263,27 @@ func (p *flyProvider) Configure(ctx context.Context, req provider.ConfigureReque
 		p.httpClient = hreq.C().DevMode()
 	}
 
-	p.httpClient.SetCommonHeader("Authorization", "Bearer "+p.token)
-	p.httpClient.SetTimeout(2 * time.Minute)
+	p.httpClient.SetCommonHeader("Authorization", utils.AuthorizationHeader(p.token))
+	p.httpClient.SetTimeout(requestTimeout)
+	if rootCAs != nil {
+		p.httpClient.GetTLSClientConfig().RootCAs = rootCAs
+	}
+	if httpProxy != "" {
+		p.httpClient.SetProxyURL(httpProxy)
+	}
 
-	// TODO: Make timeout configurable
-	h := http.Client{Timeout: 60 * time.Second, Transport: &utils.Transport{UnderlyingTransport: http.DefaultTransport, Token: token, Ctx: ctx, EnableDebugTrace: enableTracing}}
-	client := graphql.NewClient("https://api.fly.io/graphql", &h)
+	// GraphQL goes over the same transport so ca_bundle and http_proxy apply to it as well
+	h := http.Client{Timeout: requestTimeout, Transport: &utils.Transport{UnderlyingTransport: p.httpClient.GetTransport(), Token: token, Ctx: ctx, EnableDebugTrace: enableTracing, Host: graphqlURL.Host}}
+	client := graphql.NewClient(graphqlURL.String(), &h)
 	p.client = &client
 	p.configured = true
 
 	configForResources := ProviderConfig{
-		httpEndpoint: p.httpEndpoint,
-		gqclient:     p.client,
-		httpClient:   p.httpClient,
+		gqclient:      p.client,
+		machineAPI:    apiv1.NewMachineAPI(p.httpClient, p.httpEndpoint).WithRetryPolicy(retryPolicy).WithRequestTimeout(requestTimeout),
+		timeouts:      timeouts,
+		defaultOrg:    data.DefaultOrg.ValueString(),
+		defaultRegion: data.DefaultRegion.ValueString(),
 	}
 
 	resp.DataSourceData = configForResources
@@ -124,11 +292,13 @@ func (p *flyProvider) Configure(ctx context.Context, req provider.ConfigureReque
 
 func (p *flyProvider) Resources(ctx context.Context) []func() resource.Resource {
 	return []func() resource.Resource{
-		NewAppResource,     // fly_app
-		NewVolumeResource,  // fly_volume
-		NewIpResource,      // fly_ip
-		NewCertResource,    // fly_cert
-		NewMachineResource, // fly_machine
+		NewAppResource,         // fly_app
+		NewVolumeResource,      // fly_volume
+		NewIpResource,          // fly_ip
+		NewCertResource,        // fly_cert
+		NewMachineResource,     // fly_machine
+		NewMachineJobResource,  // fly_machine_job
+		NewMachineExecResource, // fly_machine_exec
 	}
 }
 
@@ -145,13 +315,76 @@ func (p *flyProvider) Schema(_ context.Context, _ provider.SchemaRequest, resp *
 	resp.Schema = schema.Schema{
 		Attributes: map[string]schema.Attribute{
 			"fly_api_token": schema.StringAttribute{
-				MarkdownDescription: "fly.io api token. If not set checks env for FLY_API_TOKEN",
+				MarkdownDescription: "fly.io api token. If not set checks env for FLY_API_TOKEN and FLY_ACCESS_TOKEN, then `token_file`, then the token flyctl is logged in with from `~/.fly/config.yml`. Macaroon tokens, e.g. `FlyV1 fm2_...` as printed by `fly tokens create`, are sent with the FlyV1 auth scheme",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"token_file": schema.StringAttribute{
+				MarkdownDescription: "Path to a file holding the api token, used when neither `fly_api_token` nor the token env vars are set",
 				Optional:            true,
 			},
 			"fly_http_endpoint": schema.StringAttribute{
-				MarkdownDescription: "Where the provider should look to find the fly http endpoint",
+				MarkdownDescription: "URL of the Machines API. A bare host means https, except for `_api.internal` and loopback hosts like a local `fly proxy`, which are served over http. If not set checks env for FLY_HTTP_ENDPOINT, then defaults to https://api.machines.dev",
+				Optional:            true,
+			},
+			"fly_api_url": schema.StringAttribute{
+				MarkdownDescription: "URL of the GraphQL API, e.g. for a staging control plane or a local stand-in. If not set checks env for FLY_API_URL, then defaults to https://api.fly.io/graphql",
+				Optional:            true,
+			},
+			"ca_bundle": schema.StringAttribute{
+				MarkdownDescription: "Path to a PEM file with additional CA certificates to trust on top of the system roots for the Machines and GraphQL APIs, e.g. for a TLS intercepting proxy",
+				Optional:            true,
+			},
+			"http_proxy": schema.StringAttribute{
+				MarkdownDescription: "Proxy URL for Machines and GraphQL API requests, overriding the HTTPS_PROXY and HTTP_PROXY env vars",
 				Optional:            true,
 			},
+			"max_retries": schema.Int64Attribute{
+				MarkdownDescription: "How many times a Machines API request failing with a transient error (429, 5xx, network) is retried. Defaults to 5, 0 disables retries",
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"retry_min_backoff": schema.StringAttribute{
+				MarkdownDescription: "Initial delay between retries as a Go duration, doubled on every attempt. Defaults to 500ms",
+				Optional:            true,
+			},
+			"retry_max_backoff": schema.StringAttribute{
+				MarkdownDescription: "Upper bound for the delay between retries as a Go duration, including delays the API asks for with Retry-After. Defaults to 30s",
+				Optional:            true,
+			},
+			"default_org": schema.StringAttribute{
+				MarkdownDescription: "Org slug used by `fly_app` when it doesn't set `org`. Without it apps fall back to the account's only org",
+				Optional:            true,
+			},
+			"default_region": schema.StringAttribute{
+				MarkdownDescription: "Region used by `fly_machine`, `fly_machine_job` and `fly_volume` when they don't set `region`",
+				Optional:            true,
+			},
+			"request_timeout": schema.StringAttribute{
+				MarkdownDescription: "Timeout for a single HTTP request to the Fly APIs as a Go duration. Whole operations are bounded by the resource timeouts instead. Defaults to 2m",
+				Optional:            true,
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"default_timeouts": schema.SingleNestedBlock{
+				MarkdownDescription: "Operation timeouts for resources that don't set a `timeouts` block, as Go durations. Reads default to 5m, everything else to 20m",
+				Attributes: map[string]schema.Attribute{
+					"create": schema.StringAttribute{
+						Optional: true,
+					},
+					"read": schema.StringAttribute{
+						Optional: true,
+					},
+					"update": schema.StringAttribute{
+						Optional: true,
+					},
+					"delete": schema.StringAttribute{
+						Optional: true,
+					},
+				},
+			},
 		},
 	}
 }
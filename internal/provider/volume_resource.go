@@ -8,10 +8,13 @@ import (
 
 	basegql "github.com/Khan/genqlient/graphql"
 	"github.com/fly-apps/terraform-provider-fly/graphql"
+	"github.com/hashicorp/terraform-plugin-framework-timeouts/resource/timeouts"
 	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
@@ -20,9 +23,12 @@ import (
 var _ resource.Resource = &flyVolumeResource{}
 var _ resource.ResourceWithConfigure = &flyVolumeResource{}
 var _ resource.ResourceWithImportState = &flyVolumeResource{}
+var _ resource.ResourceWithModifyPlan = &flyVolumeResource{}
 
 type flyVolumeResource struct {
-	client *basegql.Client
+	client        *basegql.Client
+	timeouts      resourceTimeouts
+	defaultRegion string
 }
 
 func NewVolumeResource() resource.Resource {
@@ -40,17 +46,20 @@ func (r *flyVolumeResource) Configure(_ context.Context, req resource.ConfigureR
 
 	config := req.ProviderData.(ProviderConfig)
 	r.client = config.gqclient
+	r.timeouts = config.timeouts
+	r.defaultRegion = config.defaultRegion
 }
 
 type flyVolumeResourceData struct {
-	Id     types.String `tfsdk:"id"`
-	Name   types.String `tfsdk:"name"`
-	Size   types.Int64  `tfsdk:"size"`
-	Appid  types.String `tfsdk:"app"`
-	Region types.String `tfsdk:"region"`
+	Id       types.String   `tfsdk:"id"`
+	Name     types.String   `tfsdk:"name"`
+	Size     types.Int64    `tfsdk:"size"`
+	Appid    types.String   `tfsdk:"app"`
+	Region   types.String   `tfsdk:"region"`
+	Timeouts timeouts.Value `tfsdk:"timeouts"`
 }
 
-func (r *flyVolumeResource) Schema(_ context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
+func (r *flyVolumeResource) Schema(ctx context.Context, _ resource.SchemaRequest, resp *resource.SchemaResponse) {
 	resp.Schema = schema.Schema{
 		MarkdownDescription: "Fly volume resource",
 		Attributes: map[string]schema.Attribute{
@@ -78,10 +87,37 @@ func (r *flyVolumeResource) Schema(_ context.Context, _ resource.SchemaRequest,
 				},
 			},
 			"region": schema.StringAttribute{
-				MarkdownDescription: "region",
-				Required:            true,
+				MarkdownDescription: "region, defaults to the provider's `default_region`",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
 			},
 		},
+		Blocks: map[string]schema.Block{
+			"timeouts": timeouts.Block(ctx, timeouts.Opts{
+				Create: true,
+				Read:   true,
+				Update: true,
+				Delete: true,
+			}),
+		},
+	}
+}
+
+// ModifyPlan shows the provider's default_region as region of new volumes that don't set one. Unlike machines,
+// volumes have no region picked for them, so one of the two is required.
+func (r *flyVolumeResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	planProviderDefault(ctx, req, resp, "region", "default_region", r.defaultRegion)
+	if req.Plan.Raw.IsNull() || !req.State.Raw.IsNull() || r.defaultRegion != "" {
+		return
+	}
+
+	var region types.String
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("region"), &region)...)
+	if region.IsNull() {
+		resp.Diagnostics.AddAttributeError(path.Root("region"), "Missing region", "Set region on the volume or default_region on the provider")
 	}
 }
 
@@ -90,6 +126,17 @@ func (r *flyVolumeResource) Create(ctx context.Context, req resource.CreateReque
 
 	diags := req.Plan.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	createTimeout, diags := data.Timeouts.Create(ctx, r.timeouts.Create)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, createTimeout)
+	defer cancel()
 
 	q, err := graphql.CreateVolume(ctx, *r.client, data.Appid.ValueString(), data.Name.ValueString(), data.Region.ValueString(), int(data.Size.ValueInt64()))
 	if err != nil {
@@ -98,11 +145,12 @@ func (r *flyVolumeResource) Create(ctx context.Context, req resource.CreateReque
 	}
 
 	data = flyVolumeResourceData{
-		Id:     types.StringValue(q.CreateVolume.Volume.Id),
-		Name:   types.StringValue(q.CreateVolume.Volume.Name),
-		Size:   types.Int64Value(int64(q.CreateVolume.Volume.SizeGb)),
-		Appid:  types.StringValue(data.Appid.ValueString()),
-		Region: types.StringValue(q.CreateVolume.Volume.Region),
+		Id:       types.StringValue(q.CreateVolume.Volume.Id),
+		Name:     types.StringValue(q.CreateVolume.Volume.Name),
+		Size:     types.Int64Value(int64(q.CreateVolume.Volume.SizeGb)),
+		Appid:    types.StringValue(data.Appid.ValueString()),
+		Region:   types.StringValue(q.CreateVolume.Volume.Region),
+		Timeouts: data.Timeouts,
 	}
 
 	tflog.Info(ctx, fmt.Sprintf("%+v", data))
@@ -119,6 +167,17 @@ func (r *flyVolumeResource) Read(ctx context.Context, req resource.ReadRequest,
 
 	diags := req.State.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	readTimeout, diags := data.Timeouts.Read(ctx, r.timeouts.Read)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
 
 	// strip leading vol_ off name
 	internalId := data.Id.ValueString()[4:]
@@ -136,11 +195,12 @@ func (r *flyVolumeResource) Read(ctx context.Context, req resource.ReadRequest,
 	}
 
 	data = flyVolumeResourceData{
-		Id:     types.StringValue(query.App.Volume.Id),
-		Name:   types.StringValue(query.App.Volume.Name),
-		Size:   types.Int64Value(int64(query.App.Volume.SizeGb)),
-		Appid:  types.StringValue(data.Appid.ValueString()),
-		Region: types.StringValue(query.App.Volume.Region),
+		Id:       types.StringValue(query.App.Volume.Id),
+		Name:     types.StringValue(query.App.Volume.Name),
+		Size:     types.Int64Value(int64(query.App.Volume.SizeGb)),
+		Appid:    types.StringValue(data.Appid.ValueString()),
+		Region:   types.StringValue(query.App.Volume.Region),
+		Timeouts: data.Timeouts,
 		// Internalid: types.StringValue(query.App.Volume.InternalId),
 	}
 
@@ -152,8 +212,21 @@ func (r *flyVolumeResource) Read(ctx context.Context, req resource.ReadRequest,
 }
 
 func (r *flyVolumeResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var plan, state flyVolumeResourceData
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &plan)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// timeouts are the only thing that can change in place
+	if plan.Name.Equal(state.Name) && plan.Size.Equal(state.Size) && plan.Appid.Equal(state.Appid) && plan.Region.Equal(state.Region) {
+		state.Timeouts = plan.Timeouts
+		resp.Diagnostics.Append(resp.State.Set(ctx, &state)...)
+		return
+	}
+
 	resp.Diagnostics.AddError("The fly api does not allow updating volumes once created", "Try deleting and then recreating a volume with new options")
-	return
 }
 
 func (r *flyVolumeResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
@@ -161,6 +234,17 @@ func (r *flyVolumeResource) Delete(ctx context.Context, req resource.DeleteReque
 
 	diags := req.State.Get(ctx, &data)
 	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	deleteTimeout, diags := data.Timeouts.Delete(ctx, r.timeouts.Delete)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, deleteTimeout)
+	defer cancel()
 
 	if !data.Id.IsUnknown() && !data.Id.IsNull() && data.Id.ValueString() != "" {
 		_, err := graphql.DeleteVolume(ctx, *r.client, data.Id.ValueString())
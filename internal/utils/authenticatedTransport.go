@@ -10,10 +10,14 @@ type Transport struct {
 	Token               string
 	Ctx                 context.Context
 	EnableDebugTrace    bool
+	// Host limits the token to requests for the API host, so redirects elsewhere don't carry it. Empty sends it everywhere.
+	Host string
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Add("Authorization", "Bearer "+t.Token)
+	if t.Host == "" || req.URL.Host == t.Host {
+		req.Header.Add("Authorization", AuthorizationHeader(t.Token))
+	}
 	if t.EnableDebugTrace {
 		req.Header.Add("Fly-Force-Trace", "true")
 	}
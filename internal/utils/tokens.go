@@ -0,0 +1,44 @@
+package utils
+
+import "strings"
+
+// macaroonPrefixes mark the macaroon tokens flyctl hands out, which use the FlyV1 auth scheme rather than Bearer
+var macaroonPrefixes = []string{"fm1r_", "fm1a_", "fm2_"}
+
+// flyV1Scheme is how macaroon tokens are introduced in the Authorization header, and how flyctl prints them
+const flyV1Scheme = "FlyV1 "
+
+// IsMacaroon reports whether token is a single macaroon
+func IsMacaroon(token string) bool {
+	for _, prefix := range macaroonPrefixes {
+		if strings.HasPrefix(token, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Macaroons splits a token as printed by flyctl, e.g. "FlyV1 fm2_...,fm2_...", into the macaroons it bundles:
+// the permission token followed by its discharges. Parts that aren't macaroons are dropped.
+func Macaroons(token string) []string {
+	token = strings.TrimSpace(token)
+	token = strings.TrimPrefix(token, flyV1Scheme)
+
+	var macaroons []string
+	for _, part := range strings.Split(token, ",") {
+		part = strings.TrimSpace(part)
+		if IsMacaroon(part) {
+			macaroons = append(macaroons, part)
+		}
+	}
+	return macaroons
+}
+
+// AuthorizationHeader returns the Authorization header value for token. Macaroon bundles are sent with the FlyV1
+// scheme, anything else, such as the OAuth tokens older flyctl logins produce, as a bearer token.
+func AuthorizationHeader(token string) string {
+	if macaroons := Macaroons(token); len(macaroons) > 0 {
+		return flyV1Scheme + strings.Join(macaroons, ",")
+	}
+	return "Bearer " + strings.TrimSpace(token)
+}
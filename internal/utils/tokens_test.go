@@ -0,0 +1,18 @@
+package utils
+
+import "testing"
+
+func TestAuthorizationHeader(t *testing.T) {
+	for token, expected := range map[string]string{
+		"fo1_oauth":                       "Bearer fo1_oauth",
+		"legacy-personal-token\n":         "Bearer legacy-personal-token",
+		"fm2_abc":                         "FlyV1 fm2_abc",
+		"FlyV1 fm2_abc,fm2_discharge":     "FlyV1 fm2_abc,fm2_discharge",
+		"FlyV1 fm1r_abc, fm1a_discharge ": "FlyV1 fm1r_abc,fm1a_discharge",
+		"fm2_abc,not-a-macaroon":          "FlyV1 fm2_abc",
+	} {
+		if actual := AuthorizationHeader(token); actual != expected {
+			t.Errorf("expected %q for %q, got %q", expected, token, actual)
+		}
+	}
+}
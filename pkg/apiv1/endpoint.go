@@ -0,0 +1,70 @@
+package apiv1
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DefaultEndpoint is the public Machines API
+const DefaultEndpoint = "https://api.machines.dev"
+
+// internalHost is the Machines API inside the Fly private network, reached through WireGuard or `fly proxy`,
+// which only speaks plain http
+const internalHost = "_api.internal"
+
+// ParseEndpoint turns a Machines API endpoint into the base URL requests are built from. A bare host, optionally
+// with a port, means https, except for _api.internal and loopback, e.g. a local `fly proxy`, which are only
+// served over http.
+func ParseEndpoint(endpoint string) (*url.URL, error) {
+	if !strings.Contains(endpoint, "://") {
+		host := endpoint
+		if h, _, err := net.SplitHostPort(endpoint); err == nil {
+			host = h
+		}
+		scheme := "https"
+		if isPrivateHost(host) {
+			scheme = "http"
+		}
+		endpoint = scheme + "://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q, must be http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("endpoint %q has no host", endpoint)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("endpoint %q must not have a query or fragment", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return u, nil
+}
+
+// IsPlaintext reports whether requests to u would carry the token unencrypted over the network. http to
+// _api.internal is fine since it only travels inside the WireGuard tunnel, and so is loopback.
+func IsPlaintext(u *url.URL) bool {
+	return u.Scheme != "https" && !isPrivateHost(u.Hostname())
+}
+
+// isPrivateHost reports whether host is _api.internal or loopback, which plain http never leaves the machine or
+// the WireGuard tunnel for
+func isPrivateHost(host string) bool {
+	if host == internalHost || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// url builds the address of a Machines API path, formatted like fmt.Sprintf, on top of the base URL
+func (a *MachineAPI) url(format string, args ...interface{}) string {
+	return a.baseURL.String() + fmt.Sprintf(format, args...)
+}
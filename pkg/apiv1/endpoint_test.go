@@ -0,0 +1,51 @@
+package apiv1
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	for endpoint, expected := range map[string]string{
+		"api.machines.dev":          "https://api.machines.dev",
+		"https://api.machines.dev/": "https://api.machines.dev",
+		"_api.internal:4280":        "http://_api.internal:4280",
+		"http://127.0.0.1:4280":     "http://127.0.0.1:4280",
+		"127.0.0.1:4280":            "http://127.0.0.1:4280",
+		"localhost:4280":            "http://localhost:4280",
+		"[::1]:4280":                "http://[::1]:4280",
+		"https://proxy.example/fly": "https://proxy.example/fly",
+	} {
+		u, err := ParseEndpoint(endpoint)
+		if err != nil {
+			t.Fatalf("expected %q to parse, got %s", endpoint, err)
+		}
+		if u.String() != expected {
+			t.Errorf("expected %q to become %q, got %q", endpoint, expected, u)
+		}
+	}
+
+	for _, endpoint := range []string{"ftp://api.machines.dev", "https://", "https://api.machines.dev?x=1"} {
+		if _, err := ParseEndpoint(endpoint); err == nil {
+			t.Errorf("expected %q to be rejected", endpoint)
+		}
+	}
+}
+
+func TestIsPlaintext(t *testing.T) {
+	for endpoint, expected := range map[string]bool{
+		"https://api.machines.dev":  false,
+		"http://_api.internal:4280": false,
+		"http://localhost:4280":     false,
+		"http://127.0.0.1:4280":     false,
+		"http://api.machines.dev":   true,
+	} {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsPlaintext(u) != expected {
+			t.Errorf("expected IsPlaintext(%q) to be %v", endpoint, expected)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	hreq "github.com/imroc/req/v3"
+)
+
+var RequestIDHeader = "fly-request-id"
+
+// APIError is returned by MachineAPI methods when the Machines API answers with a non-2xx status.
+type APIError struct {
+	StatusCode int
+	Status     string
+	// Message is the "error" field of the Machines API error body, or the raw body if it could not be decoded
+	Message   string
+	RequestID string
+}
+
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if e.RequestID != "" {
+		return fmt.Sprintf("machines api returned %d: %s (request id: %s)", e.StatusCode, msg, e.RequestID)
+	}
+	return fmt.Sprintf("machines api returned %d: %s", e.StatusCode, msg)
+}
+
+func newAPIError(resp *hreq.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RequestID:  resp.GetHeader(RequestIDHeader),
+	}
+	raw := resp.Bytes()
+	var body errorBody
+	if err := json.Unmarshal(raw, &body); err == nil && (body.Error != "" || body.Message != "") {
+		apiErr.Message = body.Error
+		if apiErr.Message == "" {
+			apiErr.Message = body.Message
+		}
+	} else {
+		apiErr.Message = strings.TrimSpace(string(raw))
+	}
+	return apiErr
+}
+
+// checkResponse turns a transport error or a non-2xx response into an error
+func checkResponse(resp *hreq.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccessState() {
+		return newAPIError(resp)
+	}
+	return nil
+}
+
+func statusIs(err error, codes ...int) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, code := range codes {
+		if apiErr.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNotFound reports whether err is a Machines API 404
+func IsNotFound(err error) bool {
+	return statusIs(err, http.StatusNotFound)
+}
+
+// IsConflict reports whether err is a Machines API 409
+func IsConflict(err error) bool {
+	return statusIs(err, http.StatusConflict)
+}
+
+// IsRateLimited reports whether err is a Machines API 429
+func IsRateLimited(err error) bool {
+	return statusIs(err, http.StatusTooManyRequests)
+}
+
+// leaseHeldMessage starts the error the Machines API gives, as "lease currently held by <owner>", both when
+// taking a lease someone else owns and when changing a machine without the holder's nonce
+const leaseHeldMessage = "lease currently held"
+
+// IsLeaseHeld reports whether err was caused by another holder owning the machine lease
+func IsLeaseHeld(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.StatusCode != http.StatusConflict && apiErr.StatusCode != http.StatusPreconditionFailed {
+		return false
+	}
+	return strings.Contains(strings.ToLower(apiErr.Message), leaseHeldMessage)
+}
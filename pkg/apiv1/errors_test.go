@@ -0,0 +1,97 @@
+package apiv1
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestAPIErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		status      int
+		body        string
+		message     string
+		notFound    bool
+		conflict    bool
+		leaseHeld   bool
+		rateLimited bool
+	}{
+		"json error body": {
+			status:  http.StatusBadRequest,
+			body:    `{"error": "invalid machine config"}`,
+			message: "invalid machine config",
+		},
+		"json message body": {
+			status:  http.StatusUnprocessableEntity,
+			body:    `{"message": "image not found"}`,
+			message: "image not found",
+		},
+		"non-json body": {
+			status:  http.StatusBadGateway,
+			body:    "upstream connect error\n",
+			message: "upstream connect error",
+		},
+		"not found": {
+			status:   http.StatusNotFound,
+			body:     `{"error": "machine not found"}`,
+			message:  "machine not found",
+			notFound: true,
+		},
+		"lease held": {
+			status:    http.StatusConflict,
+			body:      `{"error": "lease currently held by someone@example.com, expires at 2030-01-01T00:00:00Z"}`,
+			message:   "lease currently held by someone@example.com, expires at 2030-01-01T00:00:00Z",
+			conflict:  true,
+			leaseHeld: true,
+		},
+		"lease held without nonce": {
+			status:    http.StatusPreconditionFailed,
+			body:      `{"error": "lease currently held by someone@example.com"}`,
+			message:   "lease currently held by someone@example.com",
+			leaseHeld: true,
+		},
+		"conflict about something else": {
+			status:   http.StatusConflict,
+			body:     `{"error": "machine is still being released from a previous lease check"}`,
+			message:  "machine is still being released from a previous lease check",
+			conflict: true,
+		},
+		"rate limited": {
+			status:      http.StatusTooManyRequests,
+			body:        `{"error": "rate limit exceeded"}`,
+			message:     "rate limit exceeded",
+			rateLimited: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(RequestIDHeader, "01REQUEST")
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			})
+
+			var machine MachineResponse
+			err := api.ReadMachine(context.Background(), "app", "abc", &machine)
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected an APIError, got %v", err)
+			}
+			if apiErr.StatusCode != tc.status || apiErr.Message != tc.message || apiErr.RequestID != "01REQUEST" {
+				t.Fatalf("unexpected error %+v", apiErr)
+			}
+			if IsNotFound(err) != tc.notFound || IsConflict(err) != tc.conflict || IsLeaseHeld(err) != tc.leaseHeld || IsRateLimited(err) != tc.rateLimited {
+				t.Fatalf("unexpected predicates for %s: not found %v, conflict %v, lease held %v, rate limited %v",
+					err, IsNotFound(err), IsConflict(err), IsLeaseHeld(err), IsRateLimited(err))
+			}
+		})
+	}
+}
+
+func TestAPIErrorMessage(t *testing.T) {
+	err := &APIError{StatusCode: http.StatusNotFound, RequestID: "01REQUEST"}
+	if err.Error() != "machines api returned 404: Not Found (request id: 01REQUEST)" {
+		t.Fatalf("unexpected message %q", err)
+	}
+}
@@ -0,0 +1,169 @@
+package apiv1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	hreq "github.com/imroc/req/v3"
+)
+
+// DefaultLeaseTTL is how long a lease is requested for, it is refreshed in the background while held
+const DefaultLeaseTTL = 60 * time.Second
+
+// releaseTimeout bounds releasing a lease, which happens on a fresh context so cancelled operations still clean up
+const releaseTimeout = 30 * time.Second
+
+// Lease is a machine lease held by the provider. Mutating calls on the machine must carry Nonce,
+// and Release must be called on every exit path once the guarded operations are done.
+type Lease struct {
+	api   *MachineAPI
+	app   string
+	id    string
+	nonce string
+
+	stopRefresh context.CancelFunc
+	stopped     chan struct{}
+	releaseOnce sync.Once
+}
+
+// LeaseHeldError is returned by AcquireLease when another holder still owns the lease at the caller's deadline
+type LeaseHeldError struct {
+	Owner     string
+	ExpiresAt time.Time
+	Err       error
+}
+
+func (e *LeaseHeldError) Error() string {
+	owner := e.Owner
+	if owner == "" {
+		owner = "an unknown holder"
+	}
+	if e.ExpiresAt.IsZero() {
+		return fmt.Sprintf("machine lease is held by %s: %s", owner, e.Err)
+	}
+	return fmt.Sprintf("machine lease is held by %s until %s: %s", owner, e.ExpiresAt.Format(time.RFC3339), e.Err)
+}
+
+func (e *LeaseHeldError) Unwrap() error {
+	return e.Err
+}
+
+// GetLease returns the lease currently held on the machine, if any
+func (a *MachineAPI) GetLease(ctx context.Context, app string, id string) (*MachineLease, error) {
+	var res MachineLease
+	err := a.do(ctx, true, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetResult(&res).Get(a.url("/v1/apps/%s/machines/%s/lease", app, id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (a *MachineAPI) refreshLease(ctx context.Context, app string, id string, nonce string, ttl int) error {
+	return a.do(ctx, true, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetHeader(NonceHeader, nonce).Post(a.url("/v1/apps/%s/machines/%s/lease/?ttl=%d", app, id, ttl))
+	})
+}
+
+// AcquireLease takes the lease on a machine, waiting for other holders to let go of it until ctx is done.
+// The lease is refreshed in the background until Release is called.
+func (a *MachineAPI) AcquireLease(ctx context.Context, app string, id string, ttl time.Duration) (*Lease, error) {
+	ttlSeconds := int(ttl.Seconds())
+	if ttlSeconds < 2 {
+		ttlSeconds = int(DefaultLeaseTTL.Seconds())
+	}
+	var heldErr *LeaseHeldError
+	for attempt := 0; ; attempt++ {
+		res, err := a.LockMachine(ctx, app, id, ttlSeconds)
+		if err != nil && heldErr != nil && ctx.Err() != nil {
+			// ran out of time while asking again, the lease holder is the more useful thing to report
+			return nil, heldErr
+		}
+		if err == nil && res.Status == "success" {
+			refreshCtx, stopRefresh := context.WithCancel(context.Background())
+			lease := &Lease{
+				api:         a,
+				app:         app,
+				id:          id,
+				nonce:       res.Data.Nonce,
+				stopRefresh: stopRefresh,
+				stopped:     make(chan struct{}),
+			}
+			go lease.keepAlive(refreshCtx, ttlSeconds)
+			return lease, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("unexpected lease status %q", res.Status)
+		}
+		if !IsLeaseHeld(err) && !IsConflict(err) {
+			return nil, err
+		}
+
+		heldErr = &LeaseHeldError{Err: err}
+		wait := a.retryPolicy.backoff(attempt, nil)
+		if current, getErr := a.GetLease(ctx, app, id); getErr == nil {
+			heldErr.Owner = current.Data.Owner
+			if current.Data.ExpiresAt > 0 {
+				heldErr.ExpiresAt = time.Unix(current.Data.ExpiresAt, 0)
+				if untilExpiry := time.Until(heldErr.ExpiresAt); untilExpiry > 0 && untilExpiry < wait {
+					wait = untilExpiry
+				}
+			}
+		}
+		if sleep(ctx, wait) != nil {
+			return nil, heldErr
+		}
+	}
+}
+
+// Nonce is the value to send in the NonceHeader of requests made under this lease
+func (l *Lease) Nonce() string {
+	return l.nonce
+}
+
+// keepAlive extends the lease every half TTL until ctx is cancelled by Release
+func (l *Lease) keepAlive(ctx context.Context, ttlSeconds int) {
+	defer close(l.stopped)
+	ticker := time.NewTicker(time.Duration(ttlSeconds) * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.api.refreshLease(ctx, l.app, l.id, l.nonce, ttlSeconds); err != nil {
+				// the lease is gone or no longer ours, the guarded calls will surface that themselves
+				return
+			}
+		}
+	}
+}
+
+// Release stops refreshing the lease and gives it back. It is safe to call more than once,
+// and a machine that was destroyed under the lease is not treated as an error.
+func (l *Lease) Release() error {
+	released := false
+	l.releaseOnce.Do(func() {
+		l.stopRefresh()
+		released = true
+	})
+	if !released {
+		return nil
+	}
+	<-l.stopped
+
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	err := l.api.ReleaseMachine(ctx, MachineLease{Data: MachineLeaseData{Nonce: l.nonce}}, l.app, l.id)
+	if IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("failed to release machine lease: " + err.Error())
+	}
+	return nil
+}
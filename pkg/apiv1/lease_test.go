@@ -0,0 +1,94 @@
+package apiv1
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAcquireLeaseReportsOwner(t *testing.T) {
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"status": "success", "data": {"owner": "someone@example.com", "expires_at": 4102444800}}`))
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error": "lease currently held"}`))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := api.AcquireLease(ctx, "app", "abc", DefaultLeaseTTL)
+
+	var heldErr *LeaseHeldError
+	if !errors.As(err, &heldErr) {
+		t.Fatalf("expected a LeaseHeldError, got %v", err)
+	}
+	if heldErr.Owner != "someone@example.com" {
+		t.Fatalf("expected lease owner in error, got %q", heldErr.Owner)
+	}
+}
+
+func TestAcquireLeaseReportsOwnerWhenDeadlineHitsRetry(t *testing.T) {
+	var locks int32
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"status": "success", "data": {"owner": "someone@example.com", "expires_at": 4102444800}}`))
+			return
+		}
+		if atomic.AddInt32(&locks, 1) > 1 {
+			// hang on to the second attempt until the caller gives up
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error": "lease currently held"}`))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := api.AcquireLease(ctx, "app", "abc", DefaultLeaseTTL)
+
+	var heldErr *LeaseHeldError
+	if !errors.As(err, &heldErr) {
+		t.Fatalf("expected a LeaseHeldError rather than the deadline of the retry, got %v", err)
+	}
+	if heldErr.Owner != "someone@example.com" {
+		t.Fatalf("expected lease owner in error, got %q", heldErr.Owner)
+	}
+}
+
+func TestLeaseReleasedOnce(t *testing.T) {
+	var releases int32
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			w.Write([]byte(`{"status": "success", "data": {"nonce": "n0nce"}}`))
+		case http.MethodDelete:
+			if r.Header.Get(NonceHeader) != "n0nce" {
+				t.Errorf("expected release to carry the lease nonce")
+			}
+			atomic.AddInt32(&releases, 1)
+		}
+	})
+
+	lease, err := api.AcquireLease(context.Background(), "app", "abc", DefaultLeaseTTL)
+	if err != nil {
+		t.Fatalf("expected lease, got %s", err)
+	}
+	if err := lease.Release(); err != nil {
+		t.Fatalf("expected release to succeed, got %s", err)
+	}
+	if err := lease.Release(); err != nil {
+		t.Fatalf("expected second release to be a no-op, got %s", err)
+	}
+	if releases != 1 {
+		t.Fatalf("expected a single release call, got %d", releases)
+	}
+}
@@ -1,20 +1,35 @@
 package apiv1
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/Khan/genqlient/graphql"
 	hreq "github.com/imroc/req/v3"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var NonceHeader = "fly-machine-lease-nonce"
 
+// DefaultWaitTimeout is used by WaitForMachine, callers that know their deadline should use WaitForState
+const DefaultWaitTimeout = 5 * time.Minute
+
+// maxWaitSeconds is the longest timeout the wait endpoint accepts for a single call
+const maxWaitSeconds = 60
+
+// DefaultRequestTimeout bounds a single HTTP call to the Machines API, on top of whatever deadline the caller's context carries
+const DefaultRequestTimeout = 2 * time.Minute
+
 type MachineAPI struct {
-	client     *graphql.Client
-	httpClient *hreq.Client
-	endpoint   string
+	client         *graphql.Client
+	httpClient     *hreq.Client
+	baseURL        *url.URL
+	requestTimeout time.Duration
+	retryPolicy    RetryPolicy
 }
 
 type MachineMount struct {
@@ -25,14 +40,65 @@ type MachineMount struct {
 }
 
 type Port struct {
-	Port     int64    `json:"port"`
-	Handlers []string `json:"handlers"`
+	Port        int64        `json:"port,omitempty"`
+	StartPort   int64        `json:"start_port,omitempty"`
+	EndPort     int64        `json:"end_port,omitempty"`
+	Handlers    []string     `json:"handlers"`
+	ForceHTTPS  bool         `json:"force_https,omitempty"`
+	HTTPOptions *HTTPOptions `json:"http_options,omitempty"`
+	TLSOptions  *TLSOptions  `json:"tls_options,omitempty"`
+}
+
+type HTTPOptions struct {
+	Compress  *bool                `json:"compress,omitempty"`
+	Response  *HTTPResponseOptions `json:"response,omitempty"`
+	H2Backend *bool                `json:"h2_backend,omitempty"`
+}
+
+// HTTPResponseOptions headers are strings when set through this provider, but flyctl can also set lists
+type HTTPResponseOptions struct {
+	Headers map[string]interface{} `json:"headers,omitempty"`
+}
+
+type TLSOptions struct {
+	ALPN     []string `json:"alpn,omitempty"`
+	Versions []string `json:"versions,omitempty"`
 }
 
 type Service struct {
-	Ports        []Port `json:"ports"`
-	Protocol     string `json:"protocol"`
-	InternalPort int64  `json:"internal_port"`
+	Ports              []Port              `json:"ports"`
+	Protocol           string              `json:"protocol"`
+	InternalPort       int64               `json:"internal_port"`
+	Checks             []MachineCheck      `json:"checks,omitempty"`
+	Concurrency        *ServiceConcurrency `json:"concurrency,omitempty"`
+	Autostop           *bool               `json:"autostop,omitempty"`
+	Autostart          *bool               `json:"autostart,omitempty"`
+	MinMachinesRunning *int64              `json:"min_machines_running,omitempty"`
+}
+
+type ServiceConcurrency struct {
+	Type      string `json:"type,omitempty"`
+	SoftLimit int64  `json:"soft_limit,omitempty"`
+	HardLimit int64  `json:"hard_limit,omitempty"`
+}
+
+// MachineCheck is a health check run by the platform, durations are Go duration strings
+type MachineCheck struct {
+	Type          string               `json:"type,omitempty"`
+	Port          int64                `json:"port,omitempty"`
+	Interval      string               `json:"interval,omitempty"`
+	Timeout       string               `json:"timeout,omitempty"`
+	GracePeriod   string               `json:"grace_period,omitempty"`
+	Method        string               `json:"method,omitempty"`
+	Path          string               `json:"path,omitempty"`
+	Protocol      string               `json:"protocol,omitempty"`
+	TLSSkipVerify bool                 `json:"tls_skip_verify,omitempty"`
+	Headers       []MachineCheckHeader `json:"headers,omitempty"`
+}
+
+type MachineCheckHeader struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
 }
 
 type InitConfig struct {
@@ -42,12 +108,89 @@ type InitConfig struct {
 }
 
 type MachineConfig struct {
-	Image    string            `json:"image"`
-	Env      map[string]string `json:"env"`
-	Init     InitConfig        `json:"init,omitempty"`
-	Mounts   []MachineMount    `json:"mounts,omitempty"`
-	Services []Service         `json:"services"`
-	Guest    GuestConfig       `json:"guest,omitempty"`
+	Image    string                  `json:"image,omitempty"`
+	Env      map[string]string       `json:"env"`
+	Init     InitConfig              `json:"init,omitempty"`
+	Mounts   []MachineMount          `json:"mounts,omitempty"`
+	Services []Service               `json:"services"`
+	Guest    GuestConfig             `json:"guest,omitempty"`
+	Restart  *MachineRestart         `json:"restart,omitempty"`
+	Checks   map[string]MachineCheck `json:"checks,omitempty"`
+	Metadata map[string]string       `json:"metadata,omitempty"`
+	Files    []MachineFile           `json:"files,omitempty"`
+	// Schedule is one of hourly, daily, weekly or monthly
+	Schedule    string `json:"schedule,omitempty"`
+	AutoDestroy bool   `json:"auto_destroy,omitempty"`
+	// Containers run side by side in the machine instead of Image
+	Containers []ContainerConfig `json:"containers,omitempty"`
+}
+
+// ContainerConfig is one of several containers sharing a machine
+type ContainerConfig struct {
+	Name         string                 `json:"name"`
+	Image        string                 `json:"image"`
+	Cmd          []string               `json:"cmd,omitempty"`
+	Entrypoint   []string               `json:"entrypoint,omitempty"`
+	Env          map[string]string      `json:"env,omitempty"`
+	Files        []MachineFile          `json:"files,omitempty"`
+	Healthchecks []ContainerHealthcheck `json:"healthchecks,omitempty"`
+	DependsOn    []ContainerDependency  `json:"depends_on,omitempty"`
+}
+
+// ContainerDependency holds a container back until Name has reached Condition, one of started, healthy or
+// exited_successfully
+type ContainerDependency struct {
+	Name      string `json:"name"`
+	Condition string `json:"condition"`
+}
+
+// ContainerHealthcheck probes a container with exactly one of Exec, TCP or HTTP. Durations are in seconds.
+type ContainerHealthcheck struct {
+	Name             string                    `json:"name,omitempty"`
+	Interval         int64                     `json:"interval,omitempty"`
+	Timeout          int64                     `json:"timeout,omitempty"`
+	GracePeriod      int64                     `json:"grace_period,omitempty"`
+	FailureThreshold int64                     `json:"failure_threshold,omitempty"`
+	Exec             *ContainerExecHealthcheck `json:"exec,omitempty"`
+	TCP              *ContainerTCPHealthcheck  `json:"tcp,omitempty"`
+	HTTP             *ContainerHTTPHealthcheck `json:"http,omitempty"`
+}
+
+type ContainerExecHealthcheck struct {
+	Command []string `json:"command"`
+}
+
+type ContainerTCPHealthcheck struct {
+	Port int64 `json:"port"`
+}
+
+type ContainerHTTPHealthcheck struct {
+	Port   int64  `json:"port"`
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+// MachineFile is written into the guest at boot, either from RawValue, which is base64 encoded, or from an app secret
+type MachineFile struct {
+	GuestPath  string `json:"guest_path"`
+	RawValue   string `json:"raw_value,omitempty"`
+	SecretName string `json:"secret_name,omitempty"`
+}
+
+// Metadata keys flyctl uses to group machines
+const (
+	MetadataProcessGroup    = "fly_process_group"
+	MetadataPlatformVersion = "fly_platform_version"
+)
+
+// PlatformVersion is what MetadataPlatformVersion is set to for machines managed outside of nomad
+const PlatformVersion = "v2"
+
+// MachineRestart controls what the platform does when the machine's process exits
+type MachineRestart struct {
+	Policy     string `json:"policy,omitempty"`
+	MaxRetries int    `json:"max_retries,omitempty"`
 }
 
 type GuestConfig struct {
@@ -63,34 +206,16 @@ type MachineCreateOrUpdateRequest struct {
 }
 
 type MachineResponse struct {
-	ID         string `json:"id"`
-	Name       string `json:"name"`
-	State      string `json:"state"`
-	Region     string `json:"region"`
-	InstanceID string `json:"instance_id"`
-	PrivateIP  string `json:"private_ip"`
-	Config     struct {
-		Env  map[string]string `json:"env"`
-		Init struct {
-			Exec       []string `json:"exec"`
-			Entrypoint []string `json:"entrypoint"`
-			Cmd        []string `json:"cmd"`
-			//Tty        bool        `json:"tty"`
-		} `json:"init"`
-		Image    string      `json:"image"`
-		Metadata interface{} `json:"metadata"`
-		Restart  struct {
-			Policy string `json:"policy"`
-		} `json:"restart"`
-		Services []Service      `json:"services"`
-		Mounts   []MachineMount `json:"mounts"`
-		Guest    struct {
-			CPUKind  string `json:"cpu_kind"`
-			Cpus     int    `json:"cpus"`
-			MemoryMb int    `json:"memory_mb"`
-		} `json:"guest"`
-	} `json:"config"`
-	ImageRef struct {
+	ID         string         `json:"id"`
+	Name       string         `json:"name"`
+	State      string         `json:"state"`
+	Region     string         `json:"region"`
+	InstanceID string         `json:"instance_id"`
+	PrivateIP  string         `json:"private_ip"`
+	Config     MachineConfig  `json:"config"`
+	Checks     []CheckStatus  `json:"checks"`
+	Events     []MachineEvent `json:"events"`
+	ImageRef   struct {
 		Registry   string `json:"registry"`
 		Repository string `json:"repository"`
 		Tag        string `json:"tag"`
@@ -101,46 +226,203 @@ type MachineResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-type MachineLease struct {
+// MachineEvent is an entry in the machine's lifecycle log, newest first
+type MachineEvent struct {
+	Type   string `json:"type"`
 	Status string `json:"status"`
-	Data   struct {
-		Nonce     string `json:"nonce"`
-		ExpiresAt int64  `json:"expires_at"`
-		Owner     string `json:"owner"`
+	Source string `json:"source"`
+	// Timestamp is in milliseconds since the epoch
+	Timestamp int64                `json:"timestamp"`
+	Request   *MachineEventRequest `json:"request,omitempty"`
+}
+
+type MachineEventRequest struct {
+	ExitEvent *ExitEvent `json:"exit_event,omitempty"`
+}
+
+// ExitEvent describes how the machine's process ended
+type ExitEvent struct {
+	ExitCode      int       `json:"exit_code"`
+	ExitedAt      time.Time `json:"exited_at"`
+	OOMKilled     bool      `json:"oom_killed"`
+	RequestedStop bool      `json:"requested_stop"`
+	Signal        int       `json:"signal"`
+}
+
+// LastExit returns the most recent exit of the machine's process, or nil if it hasn't exited yet
+func (m MachineResponse) LastExit() *ExitEvent {
+	var last *ExitEvent
+	var lastTimestamp int64
+	for _, e := range m.Events {
+		if e.Type != "exit" || e.Request == nil || e.Request.ExitEvent == nil {
+			continue
+		}
+		if last == nil || e.Timestamp > lastTimestamp {
+			last = e.Request.ExitEvent
+			lastTimestamp = e.Timestamp
+		}
 	}
+	return last
+}
+
+// CheckStatus is the latest result of one of the machine's health checks
+type CheckStatus struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Output    string    `json:"output"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type MachineLease struct {
+	Status string           `json:"status"`
+	Data   MachineLeaseData `json:"data"`
+}
+
+type MachineLeaseData struct {
+	Nonce     string `json:"nonce"`
+	ExpiresAt int64  `json:"expires_at"`
+	Owner     string `json:"owner"`
 }
 
-func NewMachineAPI(httpClient *hreq.Client, endpoint string) *MachineAPI {
+// NewMachineAPI talks to the Machines API at baseURL, see ParseEndpoint
+func NewMachineAPI(httpClient *hreq.Client, baseURL *url.URL) *MachineAPI {
 	return &MachineAPI{
-		httpClient: httpClient,
-		endpoint:   endpoint,
+		httpClient:     httpClient,
+		baseURL:        baseURL,
+		requestTimeout: DefaultRequestTimeout,
+		retryPolicy:    DefaultRetryPolicy,
+	}
+}
+
+// WithRequestTimeout replaces the deadline applied to every single HTTP call made through a
+func (a *MachineAPI) WithRequestTimeout(timeout time.Duration) *MachineAPI {
+	a.requestTimeout = timeout
+	return a
+}
+
+// WithRetryPolicy replaces the retry policy used for every call made through a
+func (a *MachineAPI) WithRetryPolicy(policy RetryPolicy) *MachineAPI {
+	a.retryPolicy = policy
+	return a
+}
+
+// request builds a request bound to ctx, with a deadline of at most requestTimeout for this single call
+func (a *MachineAPI) request(ctx context.Context) (*hreq.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, a.requestTimeout)
+	return a.httpClient.R().SetContext(ctx), cancel
+}
+
+// sleep waits for d, returning early with the context error if ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
 	}
 }
 
-func (a *MachineAPI) LockMachine(app string, id string, timeout int) (*MachineLease, error) {
+func (a *MachineAPI) LockMachine(ctx context.Context, app string, id string, timeout int) (*MachineLease, error) {
 	var res MachineLease
-	_, err := a.httpClient.R().SetResult(&res).Post(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s/lease/?ttl=%d", a.endpoint, app, id, timeout))
+	err := a.do(ctx, false, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetResult(&res).Post(a.url("/v1/apps/%s/machines/%s/lease/?ttl=%d", app, id, timeout))
+	})
 	if err != nil {
 		return nil, err
 	}
 	return &res, nil
 }
 
-func (a *MachineAPI) ReleaseMachine(lease MachineLease, app string, id string) error {
-	_, err := a.httpClient.R().SetHeader(NonceHeader, lease.Data.Nonce).Delete(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s/lease", a.endpoint, app, id))
-	if err != nil {
-		return err
+func (a *MachineAPI) ReleaseMachine(ctx context.Context, lease MachineLease, app string, id string) error {
+	return a.do(ctx, true, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetHeader(NonceHeader, lease.Data.Nonce).Delete(a.url("/v1/apps/%s/machines/%s/lease", app, id))
+	})
+}
+
+// WaitForMachine waits for the given instance of the machine to be started
+func (a *MachineAPI) WaitForMachine(ctx context.Context, app string, id string, instanceID string) error {
+	return a.WaitForState(ctx, app, id, instanceID, "started", DefaultWaitTimeout)
+}
+
+// WaitForState blocks until the machine reaches state or timeout elapses. The server side wait endpoint
+// caps a single call at maxWaitSeconds, so it is called in a loop until the deadline.
+// instanceID may be empty to wait on whichever instance is current.
+func (a *MachineAPI) WaitForState(ctx context.Context, app string, id string, instanceID string, state string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	for {
+		waitSeconds := int(time.Until(deadline).Seconds())
+		if waitSeconds > maxWaitSeconds {
+			waitSeconds = maxWaitSeconds
+		}
+		// leave the server room to answer before our own per-request deadline
+		if limit := int(a.requestTimeout.Seconds()) - 5; waitSeconds > limit {
+			waitSeconds = limit
+		}
+		if waitSeconds < 1 {
+			waitSeconds = 1
+		}
+		err := a.do(ctx, true, func(r *hreq.Request) (*hreq.Response, error) {
+			if instanceID != "" {
+				r.SetQueryParam("instance_id", instanceID)
+			}
+			return r.SetQueryParams(map[string]string{
+				"state":   state,
+				"timeout": strconv.Itoa(waitSeconds),
+			}).Get(a.url("/v1/apps/%s/machines/%s/wait", app, id))
+		})
+		if err == nil {
+			return nil
+		}
+		if !statusIs(err, http.StatusRequestTimeout) && !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return err
+		}
+
+		// the machine can't get to the requested state once it has failed or been destroyed, so don't wait out the timeout
+		var machine MachineResponse
+		var readErr error
+		if ctx.Err() != nil {
+			// out of time, a last quick look at the machine still makes for a better error than the deadline
+			readCtx, readCancel := context.WithTimeout(context.Background(), lastLookTimeout)
+			readErr = a.readMachineOnce(readCtx, app, id, &machine)
+			readCancel()
+		} else {
+			readErr = a.ReadMachine(ctx, app, id, &machine)
+		}
+		if readErr != nil {
+			return err
+		}
+		if machine.State == state {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("machine %s did not reach state %q within %s, it is currently %q", id, state, timeout, machine.State)
+		}
+		if machine.State == "failed" || machine.State == "destroyed" {
+			return fmt.Errorf("machine %s is %q and will not reach state %q", id, machine.State, state)
+		}
 	}
-	return nil
 }
 
-func (a *MachineAPI) WaitForMachine(app string, id string, instanceID string) error {
-	_, err := a.httpClient.R().Get(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s/wait?instance_id=%s", a.endpoint, app, id, instanceID))
-	return err
+// lastLookTimeout bounds the single read WaitForState makes after its deadline has passed
+const lastLookTimeout = 10 * time.Second
+
+// readMachineOnce reads the machine without retrying, for when there is no time left to retry in
+func (a *MachineAPI) readMachineOnce(ctx context.Context, app string, id string, res *MachineResponse) error {
+	single := *a
+	single.retryPolicy.MaxRetries = 0
+	return single.ReadMachine(ctx, app, id, res)
 }
 
 // CreateMachine takes a MachineCreateOrUpdateRequest and creates the requested machine in the given app and then writes the response into the `res` param
-func (a *MachineAPI) CreateMachine(req MachineCreateOrUpdateRequest, app string, res *MachineResponse) error {
+func (a *MachineAPI) CreateMachine(ctx context.Context, req MachineCreateOrUpdateRequest, app string, res *MachineResponse) error {
 	if req.Config.Guest.CpuType == "" {
 		req.Config.Guest.CpuType = "shared"
 	}
@@ -150,19 +432,14 @@ func (a *MachineAPI) CreateMachine(req MachineCreateOrUpdateRequest, app string,
 	if req.Config.Guest.MemoryMb == 0 {
 		req.Config.Guest.MemoryMb = 256
 	}
-	createResponse, err := a.httpClient.R().SetBody(req).SetResult(res).Post(fmt.Sprintf("http://%s/v1/apps/%s/machines", a.endpoint, app))
-
-	if err != nil {
-		return err
-	}
-
-	if createResponse.StatusCode != http.StatusCreated && createResponse.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("Create request failed: %s, %+v", createResponse.Status, createResponse))
-	}
-	return nil
+	// creating is not idempotent, so this is only retried when the API tells us it did not act on the request
+	return a.do(ctx, false, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetBody(req).SetResult(res).Post(a.url("/v1/apps/%s/machines", app))
+	})
 }
 
-func (a *MachineAPI) UpdateMachine(req MachineCreateOrUpdateRequest, app string, id string, res *MachineResponse) error {
+// UpdateMachine pushes a new config to the machine. nonce must come from a Lease held on the machine.
+func (a *MachineAPI) UpdateMachine(ctx context.Context, req MachineCreateOrUpdateRequest, app string, id string, nonce string, res *MachineResponse) error {
 	if req.Config.Guest.CpuType == "" {
 		req.Config.Guest.CpuType = "shared"
 	}
@@ -174,58 +451,307 @@ func (a *MachineAPI) UpdateMachine(req MachineCreateOrUpdateRequest, app string,
 		//You can't have a machine with no memory
 		req.Config.Guest.MemoryMb = 256
 	}
-	lease, err := a.LockMachine(app, id, 30)
-	if err != nil {
-		return err
+	// pushing the same config twice is harmless, so updates can be repeated
+	return a.do(ctx, true, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetBody(req).SetResult(res).SetHeader(NonceHeader, nonce).Post(a.url("/v1/apps/%s/machines/%s", app, id))
+	})
+}
+
+func (a *MachineAPI) ReadMachine(ctx context.Context, app string, id string, res *MachineResponse) error {
+	return a.do(ctx, true, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetResult(res).Get(a.url("/v1/apps/%s/machines/%s", app, id))
+	})
+}
+
+// StartMachine boots a stopped or suspended machine. nonce must come from a Lease held on the machine.
+func (a *MachineAPI) StartMachine(ctx context.Context, app string, id string, nonce string) error {
+	return a.do(ctx, true, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetHeader(NonceHeader, nonce).Post(a.url("/v1/apps/%s/machines/%s/start", app, id))
+	})
+}
+
+// StopMachine shuts a machine down. nonce must come from a Lease held on the machine.
+func (a *MachineAPI) StopMachine(ctx context.Context, app string, id string, nonce string) error {
+	return a.do(ctx, true, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetHeader(NonceHeader, nonce).Post(a.url("/v1/apps/%s/machines/%s/stop", app, id))
+	})
+}
+
+// SuspendMachine snapshots a started machine's memory and stops it. nonce must come from a Lease held on the machine.
+func (a *MachineAPI) SuspendMachine(ctx context.Context, app string, id string, nonce string) error {
+	return a.do(ctx, true, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetHeader(NonceHeader, nonce).Post(a.url("/v1/apps/%s/machines/%s/suspend", app, id))
+	})
+}
+
+func (a *MachineAPI) destroyMachine(ctx context.Context, app string, id string, nonce string, force bool) error {
+	return a.do(ctx, true, func(r *hreq.Request) (*hreq.Response, error) {
+		if force {
+			r.SetQueryParam("force", "true")
+		}
+		return r.SetHeader(NonceHeader, nonce).Delete(a.url("/v1/apps/%s/machines/%s", app, id))
+	})
+}
+
+// remaining is how long is left before ctx's deadline, or DefaultWaitTimeout if it has none
+func remaining(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
 	}
-	reqRes, err := a.httpClient.R().SetBody(req).SetResult(res).SetHeader(NonceHeader, lease.Data.Nonce).Post(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s", a.endpoint, app, id))
-	if err != nil {
-		return err
+	return DefaultWaitTimeout
+}
+
+// DeleteMachine destroys the machine and waits until it is gone. Unless force is set, a running machine is
+// stopped first. nonce must come from a Lease held on the machine.
+func (a *MachineAPI) DeleteMachine(ctx context.Context, app string, id string, nonce string, force bool) error {
+	var machine MachineResponse
+	err := a.ReadMachine(ctx, app, id, &machine)
+	if IsNotFound(err) {
+		return nil
 	}
-	err = a.ReleaseMachine(*lease, app, id)
 	if err != nil {
 		return err
 	}
-	if reqRes.StatusCode != http.StatusCreated && reqRes.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("Update request failed: %s, %+v", reqRes.Status, reqRes))
+
+	switch machine.State {
+	case "destroyed":
+		return nil
+	case "destroying":
+		// already on its way out
+	default:
+		if !force {
+			if err := a.settleForDestroy(ctx, app, id, nonce, machine); err != nil {
+				return err
+			}
+		}
+		err = a.destroyMachine(ctx, app, id, nonce, force)
+		if IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = a.WaitForState(ctx, app, id, machine.InstanceID, "destroyed", remaining(ctx))
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// settleForDestroy brings the machine into a state it can be destroyed from without forcing it
+func (a *MachineAPI) settleForDestroy(ctx context.Context, app string, id string, nonce string, machine MachineResponse) error {
+	switch machine.State {
+	case "created", "stopped", "suspended", "failed", "replaced":
+		return nil
+	case "suspending":
+		return a.WaitForState(ctx, app, id, machine.InstanceID, "suspended", remaining(ctx))
+	case "stopping":
+		return a.WaitForState(ctx, app, id, machine.InstanceID, "stopped", remaining(ctx))
+	case "starting", "replacing":
+		// the machine can't be stopped halfway through booting
+		if err := a.WaitForState(ctx, app, id, machine.InstanceID, "started", remaining(ctx)); err != nil {
+			return err
+		}
+		fallthrough
+	case "started":
+		if err := a.StopMachine(ctx, app, id, nonce); err != nil {
+			return err
+		}
+		return a.WaitForState(ctx, app, id, machine.InstanceID, "stopped", remaining(ctx))
+	default:
+		// unknown state, let the destroy call tell us whether that works
+		return nil
 	}
-	return nil
 }
 
-func (a *MachineAPI) ReadMachine(app string, id string, res *MachineResponse) (*hreq.Response, error) {
-	return a.httpClient.R().SetResult(res).Get(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s", a.endpoint, app, id))
+// NormalizeState maps transitional machine states to the state they are heading for, and "created" to "stopped"
+// since a machine that was never launched is not running either. A freshly created machine also reports "created"
+// while it is still launching, so wait for its launch before relying on this.
+func NormalizeState(state string) string {
+	switch state {
+	case "created", "stopping":
+		return "stopped"
+	case "starting":
+		return "started"
+	case "suspending":
+		return "suspended"
+	}
+	return state
 }
 
-func (a *MachineAPI) DeleteMachine(app string, id string, maxRetries int) error {
-	deleted := false
-	for i := 0; i < maxRetries; i++ {
-		var machine MachineResponse
-		readResponse, err := a.httpClient.R().SetResult(&machine).Get(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s", a.endpoint, app, id))
-		if err != nil {
+// SetState starts, stops or suspends the machine until it is in state, which is one of "started", "stopped"
+// or "suspended". nonce must come from a Lease held on the machine.
+func (a *MachineAPI) SetState(ctx context.Context, app string, id string, nonce string, state string) error {
+	var machine MachineResponse
+	if err := a.ReadMachine(ctx, app, id, &machine); err != nil {
+		return err
+	}
+
+	// let transitions that are already underway finish before deciding what to do
+	current := machine.State
+	switch current {
+	case "starting", "stopping", "suspending":
+		current = NormalizeState(current)
+		if err := a.WaitForState(ctx, app, id, machine.InstanceID, current, remaining(ctx)); err != nil {
 			return err
 		}
+	}
+	if NormalizeState(current) == state {
+		return nil
+	}
 
-		if readResponse.StatusCode == 200 {
-			if machine.State == "started" || machine.State == "starting" || machine.State == "replacing" {
-				_, _ = a.httpClient.R().Post(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s/stop", a.endpoint, app, id))
+	switch state {
+	case "started":
+		if err := a.StartMachine(ctx, app, id, nonce); err != nil {
+			return err
+		}
+		return a.WaitForState(ctx, app, id, machine.InstanceID, "started", remaining(ctx))
+	case "stopped":
+		if err := a.StopMachine(ctx, app, id, nonce); err != nil {
+			return err
+		}
+		return a.WaitForState(ctx, app, id, machine.InstanceID, "stopped", remaining(ctx))
+	case "suspended":
+		// only a running machine can be suspended
+		if current != "started" {
+			if err := a.StartMachine(ctx, app, id, nonce); err != nil {
+				return err
 			}
-			if machine.State == "stopping" || machine.State == "destroying" {
-				time.Sleep(5 * time.Second)
+			if err := a.WaitForState(ctx, app, id, machine.InstanceID, "started", remaining(ctx)); err != nil {
+				return err
 			}
-			if machine.State == "stopped" || machine.State == "replaced" {
-				_, err = a.httpClient.R().Delete(fmt.Sprintf("http://%s/v1/apps/%s/machines/%s", a.endpoint, app, id))
-				if err != nil {
-					return err
-				}
+		}
+		if err := a.SuspendMachine(ctx, app, id, nonce); err != nil {
+			return err
+		}
+		return a.WaitForState(ctx, app, id, machine.InstanceID, "suspended", remaining(ctx))
+	}
+	return fmt.Errorf("unsupported machine state %q", state)
+}
+
+// checkPollInterval is how often WaitForChecks looks at the check results, the API has no wait endpoint for them
+var checkPollInterval = 2 * time.Second
+
+// ChecksFailedError is returned by WaitForChecks when checks are still not passing at the deadline
+type ChecksFailedError struct {
+	Checks []CheckStatus
+}
+
+func (e *ChecksFailedError) Error() string {
+	if len(e.Checks) == 0 {
+		return "health checks have not reported a result yet"
+	}
+	var failed []string
+	for _, c := range e.Checks {
+		failed = append(failed, fmt.Sprintf("check %q is %s: %s", c.Name, c.Status, strings.TrimSpace(c.Output)))
+	}
+	return strings.Join(failed, "; ")
+}
+
+// WaitForChecks polls the machine until all of its health checks pass or timeout elapses
+func (a *MachineAPI) WaitForChecks(ctx context.Context, app string, id string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var failing []CheckStatus
+	for attempt := 0; ; attempt++ {
+		var machine MachineResponse
+		if err := a.ReadMachine(ctx, app, id, &machine); err != nil {
+			if attempt > 0 && ctx.Err() != nil {
+				return &ChecksFailedError{Checks: failing}
 			}
-			if machine.State == "destroyed" {
-				deleted = true
-				break
+			return err
+		}
+		if !machine.Config.hasChecks() {
+			return nil
+		}
+
+		failing = nil
+		for _, c := range machine.Checks {
+			if c.Status != "passing" {
+				failing = append(failing, c)
 			}
 		}
+		// checks show up some time after the machine starts, so an empty list isn't a pass
+		if len(machine.Checks) > 0 && len(failing) == 0 {
+			return nil
+		}
+
+		if sleep(ctx, checkPollInterval) != nil {
+			return &ChecksFailedError{Checks: failing}
+		}
+	}
+}
+
+func (c MachineConfig) hasChecks() bool {
+	if len(c.Checks) > 0 {
+		return true
 	}
-	if !deleted {
-		return errors.New("max retries exceeded")
+	for _, s := range c.Services {
+		if len(s.Checks) > 0 {
+			return true
+		}
 	}
-	return nil
+	return false
+}
+
+// WaitForExit blocks until the process of an auto_destroy machine has exited and the machine is gone,
+// then returns how the process ended
+func (a *MachineAPI) WaitForExit(ctx context.Context, app string, id string, instanceID string) (*ExitEvent, error) {
+	err := a.WaitForState(ctx, app, id, instanceID, "destroyed", remaining(ctx))
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+
+	var machine MachineResponse
+	err = a.ReadMachine(ctx, app, id, &machine)
+	if IsNotFound(err) {
+		return nil, fmt.Errorf("machine %s is gone and its exit status can no longer be read", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	exit := machine.LastExit()
+	if exit == nil {
+		return nil, fmt.Errorf("machine %s is %q but has no exit event", id, machine.State)
+	}
+	return exit, nil
+}
+
+type execRequest struct {
+	Command []string `json:"command"`
+	Timeout int      `json:"timeout,omitempty"`
+}
+
+// ExecResponse is the outcome of a command run with Exec
+type ExecResponse struct {
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	ExitCode   int    `json:"exit_code"`
+	ExitSignal int    `json:"exit_signal"`
+}
+
+// Exec runs command in the started machine and returns its output once it exits or timeout elapses. The whole
+// call has to fit into the client's request timeout, so longer timeouts are cut down to that.
+func (a *MachineAPI) Exec(ctx context.Context, app string, id string, command []string, timeout time.Duration) (*ExecResponse, error) {
+	timeoutSeconds := int(timeout.Seconds())
+	// leave the server room to answer before our own per-request deadline
+	if limit := int(a.requestTimeout.Seconds()) - 5; timeoutSeconds > limit {
+		timeoutSeconds = limit
+	}
+	if timeoutSeconds < 1 {
+		timeoutSeconds = 1
+	}
+
+	var res ExecResponse
+	// running the command twice is not safe, so this is only retried when the API tells us it did not act on the request
+	err := a.do(ctx, false, func(r *hreq.Request) (*hreq.Response, error) {
+		return r.SetBody(execRequest{Command: command, Timeout: timeoutSeconds}).SetResult(&res).Post(a.url("/v1/apps/%s/machines/%s/exec", app, id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
 }
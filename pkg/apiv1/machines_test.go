@@ -0,0 +1,242 @@
+package apiv1
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeleteMachineStopsBeforeDestroy(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		if r.Method == http.MethodGet && !strings.HasSuffix(r.URL.Path, "/wait") {
+			w.Write([]byte(`{"id": "abc", "state": "started", "instance_id": "01"}`))
+			return
+		}
+		if r.Method == http.MethodDelete && r.URL.Query().Get("force") != "" {
+			t.Errorf("expected a graceful destroy")
+		}
+		w.Write([]byte(`{"ok": true}`))
+	})
+
+	if err := api.DeleteMachine(context.Background(), "app", "abc", "n0nce", false); err != nil {
+		t.Fatalf("expected delete to succeed, got %s", err)
+	}
+	expected := []string{
+		"GET /v1/apps/app/machines/abc",
+		"POST /v1/apps/app/machines/abc/stop",
+		"GET /v1/apps/app/machines/abc/wait",
+		"DELETE /v1/apps/app/machines/abc",
+		"GET /v1/apps/app/machines/abc/wait",
+	}
+	if strings.Join(calls, ", ") != strings.Join(expected, ", ") {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+}
+
+func TestDeleteMachineForce(t *testing.T) {
+	var forced bool
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			t.Errorf("expected a forced delete not to stop the machine")
+		case r.Method == http.MethodDelete:
+			forced = r.URL.Query().Get("force") == "true"
+		case strings.HasSuffix(r.URL.Path, "/wait"):
+			if r.URL.Query().Get("state") != "destroyed" {
+				t.Errorf("expected to wait for destroyed, got %q", r.URL.Query().Get("state"))
+			}
+		default:
+			w.Write([]byte(`{"id": "abc", "state": "started"}`))
+			return
+		}
+		w.Write([]byte(`{"ok": true}`))
+	})
+
+	if err := api.DeleteMachine(context.Background(), "app", "abc", "n0nce", true); err != nil {
+		t.Fatalf("expected delete to succeed, got %s", err)
+	}
+	if !forced {
+		t.Fatal("expected destroy to be forced")
+	}
+}
+
+func TestDeleteMachineAlreadyGone(t *testing.T) {
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	if err := api.DeleteMachine(context.Background(), "app", "abc", "n0nce", false); err != nil {
+		t.Fatalf("expected deleting a missing machine to succeed, got %s", err)
+	}
+}
+
+func TestSetStateSuspendsStoppedMachine(t *testing.T) {
+	var calls []string
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			calls = append(calls, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		}
+		if r.Method == http.MethodGet && !strings.HasSuffix(r.URL.Path, "/wait") {
+			w.Write([]byte(`{"id": "abc", "state": "stopped"}`))
+			return
+		}
+		w.Write([]byte(`{"ok": true}`))
+	})
+
+	if err := api.SetState(context.Background(), "app", "abc", "n0nce", "suspended"); err != nil {
+		t.Fatalf("expected suspend to succeed, got %s", err)
+	}
+	if strings.Join(calls, ", ") != "start, suspend" {
+		t.Fatalf("expected the machine to be started before suspending, got %v", calls)
+	}
+}
+
+func TestSetStateNoopWhenAlreadyThere(t *testing.T) {
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"id": "abc", "state": "created"}`))
+	})
+
+	if err := api.SetState(context.Background(), "app", "abc", "n0nce", "stopped"); err != nil {
+		t.Fatalf("expected no-op to succeed, got %s", err)
+	}
+}
+
+// setCheckPollInterval speeds up WaitForChecks for a test and puts the interval back afterwards
+func setCheckPollInterval(t *testing.T, interval time.Duration) {
+	previous := checkPollInterval
+	checkPollInterval = interval
+	t.Cleanup(func() { checkPollInterval = previous })
+}
+
+func TestWaitForChecksPassing(t *testing.T) {
+	setCheckPollInterval(t, time.Millisecond)
+	var reads int32
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&reads, 1) < 3 {
+			w.Write([]byte(`{"id": "abc", "config": {"checks": {"alive": {"type": "tcp"}}}, "checks": [{"name": "alive", "status": "critical"}]}`))
+			return
+		}
+		w.Write([]byte(`{"id": "abc", "config": {"checks": {"alive": {"type": "tcp"}}}, "checks": [{"name": "alive", "status": "passing"}]}`))
+	})
+
+	if err := api.WaitForChecks(context.Background(), "app", "abc", time.Second); err != nil {
+		t.Fatalf("expected checks to pass, got %s", err)
+	}
+}
+
+func TestWaitForChecksReportsCritical(t *testing.T) {
+	setCheckPollInterval(t, time.Millisecond)
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "abc", "config": {"checks": {"alive": {"type": "tcp"}}}, "checks": [{"name": "alive", "status": "critical", "output": "connection refused"}]}`))
+	})
+
+	err := api.WaitForChecks(context.Background(), "app", "abc", 20*time.Millisecond)
+	var checksErr *ChecksFailedError
+	if !errors.As(err, &checksErr) {
+		t.Fatalf("expected a ChecksFailedError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), `check "alive" is critical: connection refused`) {
+		t.Fatalf("expected check name and output in error, got %q", err)
+	}
+}
+
+func TestWaitForExitReturnsLastExit(t *testing.T) {
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/wait") {
+			w.Write([]byte(`{"ok": true}`))
+			return
+		}
+		w.Write([]byte(`{"id": "abc", "state": "destroyed", "events": [
+			{"type": "destroy", "status": "destroyed", "timestamp": 1700000003000},
+			{"type": "exit", "status": "stopped", "timestamp": 1700000002000, "request": {"exit_event": {"exit_code": 3, "exited_at": "2023-11-14T22:13:22Z"}}},
+			{"type": "exit", "status": "stopped", "timestamp": 1700000001000, "request": {"exit_event": {"exit_code": 0, "exited_at": "2023-11-14T22:13:21Z"}}}
+		]}`))
+	})
+
+	exit, err := api.WaitForExit(context.Background(), "app", "abc", "01")
+	if err != nil {
+		t.Fatalf("expected exit status, got %s", err)
+	}
+	if exit.ExitCode != 3 {
+		t.Fatalf("expected the latest exit code 3, got %d", exit.ExitCode)
+	}
+	if !exit.ExitedAt.Equal(time.Date(2023, 11, 14, 22, 13, 22, 0, time.UTC)) {
+		t.Fatalf("unexpected exit time %s", exit.ExitedAt)
+	}
+}
+
+func TestExec(t *testing.T) {
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"command":["echo","hi"],"timeout":30}` {
+			t.Errorf("unexpected exec request %s", body)
+		}
+		w.Write([]byte(`{"stdout": "hi\n", "stderr": "", "exit_code": 0}`))
+	})
+
+	res, err := api.Exec(context.Background(), "app", "abc", []string{"echo", "hi"}, 30*time.Second)
+	if err != nil {
+		t.Fatalf("expected exec to succeed, got %s", err)
+	}
+	if res.Stdout != "hi\n" || res.ExitCode != 0 {
+		t.Fatalf("unexpected exec result %+v", res)
+	}
+}
+
+func TestWaitForStateReportsStateAtDeadline(t *testing.T) {
+	var reads int32
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/wait") {
+			<-r.Context().Done()
+			return
+		}
+		atomic.AddInt32(&reads, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	err := api.WaitForState(context.Background(), "app", "abc", "01", "started", 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected the wait to time out")
+	}
+	if reads != 1 {
+		t.Fatalf("expected a single read after the deadline, got %d", reads)
+	}
+}
+
+func TestWaitForStateStopsOnCancel(t *testing.T) {
+	var reads int32
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/wait") {
+			<-r.Context().Done()
+			return
+		}
+		atomic.AddInt32(&reads, 1)
+		w.Write([]byte(`{"id": "abc", "state": "starting"}`))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := api.WaitForState(ctx, "app", "abc", "01", "started", time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the wait to be cancelled, got %v", err)
+	}
+	if reads != 0 {
+		t.Fatalf("expected no reads after cancel, got %d", reads)
+	}
+}
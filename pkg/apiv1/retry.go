@@ -0,0 +1,102 @@
+package apiv1
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	hreq "github.com/imroc/req/v3"
+)
+
+// RetryPolicy controls how MachineAPI retries requests that fail with a transient error
+type RetryPolicy struct {
+	// MaxRetries is the number of additional attempts after the first one, 0 disables retries
+	MaxRetries int
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between attempts, including one asked for with Retry-After
+	MaxBackoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	MinBackoff: 500 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+}
+
+// backoff returns a capped exponential delay with jitter for the given zero-based attempt.
+// A Retry-After header on resp takes precedence.
+func (p RetryPolicy) backoff(attempt int, resp *hreq.Response) time.Duration {
+	if d, ok := retryAfter(resp); ok {
+		// a server asking for minutes or hours would stall the whole apply, MaxBackoff is as long as we wait
+		if d > p.MaxBackoff {
+			d = p.MaxBackoff
+		}
+		return d
+	}
+	capped := math.Min(float64(p.MaxBackoff), float64(p.MinBackoff)*math.Exp2(float64(attempt)))
+	half := int64(capped / 2)
+	if half <= 0 {
+		return time.Duration(capped)
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func retryAfter(resp *hreq.Response) (time.Duration, bool) {
+	if resp == nil || resp.Response == nil {
+		return 0, false
+	}
+	header := resp.GetHeader("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		d := time.Until(at)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// shouldRetry decides whether a failed call is worth another attempt.
+// Requests that are not repeatable are only retried when the API guarantees it did not act on them.
+func shouldRetry(err error, repeatable bool) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		// transport error or per-request timeout, we can't tell whether the request reached the API
+		return repeatable
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusInternalServerError:
+		return repeatable
+	}
+	return false
+}
+
+// do sends a request built by send, retrying transient failures according to the retry policy.
+// Each attempt gets its own per-request deadline derived from ctx.
+func (a *MachineAPI) do(ctx context.Context, repeatable bool, send func(r *hreq.Request) (*hreq.Response, error)) error {
+	for attempt := 0; ; attempt++ {
+		r, cancel := a.request(ctx)
+		resp, err := send(r)
+		err = checkResponse(resp, err)
+		cancel()
+		if err == nil || ctx.Err() != nil || attempt >= a.retryPolicy.MaxRetries || !shouldRetry(err, repeatable) {
+			return err
+		}
+		if sleepErr := sleep(ctx, a.retryPolicy.backoff(attempt, resp)); sleepErr != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package apiv1
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hreq "github.com/imroc/req/v3"
+)
+
+func testMachineAPI(t *testing.T, handler http.HandlerFunc) *MachineAPI {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	baseURL, err := ParseEndpoint(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMachineAPI(hreq.C(), baseURL).WithRetryPolicy(RetryPolicy{
+		MaxRetries: 3,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+	})
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	var calls int32
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id": "abc", "state": "started"}`))
+	})
+
+	var machine MachineResponse
+	if err := api.ReadMachine(context.Background(), "app", "abc", &machine); err != nil {
+		t.Fatalf("expected read to succeed after retries, got %s", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestNoRetryForNonRepeatableServerError(t *testing.T) {
+	var calls int32
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	var machine MachineResponse
+	err := api.CreateMachine(context.Background(), MachineCreateOrUpdateRequest{}, "app", &machine)
+	if err == nil {
+		t.Fatal("expected create to fail")
+	}
+	if calls != 1 {
+		t.Fatalf("expected create not to be retried, got %d calls", calls)
+	}
+}
+
+func TestRetryAfterIsHonoured(t *testing.T) {
+	var calls int32
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"id": "abc"}`))
+	})
+	api.retryPolicy.MaxBackoff = 2 * time.Second
+
+	start := time.Now()
+	var machine MachineResponse
+	if err := api.CreateMachine(context.Background(), MachineCreateOrUpdateRequest{}, "app", &machine); err != nil {
+		t.Fatalf("expected rate limited create to be retried, got %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("expected to wait for Retry-After, only waited %s", elapsed)
+	}
+}
+
+func TestRetryAfterIsCappedAtMaxBackoff(t *testing.T) {
+	var calls int32
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"id": "abc"}`))
+	})
+	api.retryPolicy.MaxBackoff = 10 * time.Millisecond
+
+	start := time.Now()
+	var machine MachineResponse
+	if err := api.CreateMachine(context.Background(), MachineCreateOrUpdateRequest{}, "app", &machine); err != nil {
+		t.Fatalf("expected rate limited create to be retried, got %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected Retry-After to be capped at MaxBackoff, waited %s", elapsed)
+	}
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	api := testMachineAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	api.retryPolicy.MaxRetries = 100
+	api.retryPolicy.MinBackoff = time.Minute
+	api.retryPolicy.MaxBackoff = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var machine MachineResponse
+	if err := api.ReadMachine(ctx, "app", "abc", &machine); err == nil {
+		t.Fatal("expected read to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected cancellation to interrupt backoff, took %s", elapsed)
+	}
+}